@@ -0,0 +1,131 @@
+package gomatrix
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Bot is a thin convenience layer over a Client for the common bot use case: sync, optionally accept invites
+// automatically and dispatch incoming messages to callbacks.
+//
+// Bot registers listeners on the Client's DefaultSyncer, so it cannot be used with a custom Syncer.
+type Bot struct {
+	Client *Client
+	// If true, invites for the bot's user are accepted by calling JoinRoom as soon as they appear in /sync. Rooms
+	// are joined in their own goroutine, so a slow join doesn't hold up the processing of the rest of the /sync.
+	AutoJoinInvites bool
+	// If not empty, only invites sent by these user IDs are accepted automatically. Other invites are ignored.
+	AllowedInviters []string
+	// Called after the bot has automatically joined a room it was invited to. It is called from the goroutine which
+	// joined the room, so it may run concurrently with other callbacks.
+	OnJoin func(roomID, inviter string)
+	// Called if automatically joining a room fails, from the same goroutine as OnJoin would have been. The invite
+	// will be retried if it appears in a later /sync.
+	OnJoinError func(roomID, inviter string, err error)
+
+	syncer *DefaultSyncer
+
+	syncCtxMutex sync.Mutex      // protects syncCtx
+	syncCtx      context.Context // the context of the running Sync, used to join rooms
+
+	joiningMutex sync.Mutex      // protects joining
+	joining      map[string]bool // room IDs being joined or joined and not left since, to debounce duplicate invites
+}
+
+// NewBot creates a Bot for the given Client. The Client's Syncer must be a *DefaultSyncer, which is the case for
+// clients created with NewClient.
+func NewBot(cli *Client) (*Bot, error) {
+	syncer, ok := cli.Syncer.(*DefaultSyncer)
+	if !ok {
+		return nil, fmt.Errorf("bot requires a *DefaultSyncer, got %T", cli.Syncer)
+	}
+	b := &Bot{
+		Client:  cli,
+		syncer:  syncer,
+		syncCtx: context.Background(),
+		joining: make(map[string]bool),
+	}
+	syncer.OnEventType("m.room.member", b.onMember)
+	return b, nil
+}
+
+// OnMessage registers a callback for m.room.message events.
+func (b *Bot) OnMessage(callback OnEventListener) {
+	b.syncer.OnEventType("m.room.message", callback)
+}
+
+// OnEventType registers a callback for the given event type. See DefaultSyncer.OnEventType.
+func (b *Bot) OnEventType(eventType string, callback OnEventListener) {
+	b.syncer.OnEventType(eventType, callback)
+}
+
+// Sync starts syncing. Rooms are joined with the given context, so cancelling it also cancels any pending
+// automatic joins. See Client.Sync.
+func (b *Bot) Sync(ctx context.Context) error {
+	b.syncCtxMutex.Lock()
+	b.syncCtx = ctx
+	b.syncCtxMutex.Unlock()
+	return b.Client.Sync(ctx)
+}
+
+func (b *Bot) onMember(ev *Event) {
+	if ev.StateKey == nil || *ev.StateKey != b.Client.UserID {
+		return
+	}
+	switch membership, _ := ev.Content["membership"].(string); membership {
+	case "invite":
+	case "leave", "ban":
+		// Forget the room, so that a later invite to it is accepted again.
+		b.joiningMutex.Lock()
+		delete(b.joining, ev.RoomID)
+		b.joiningMutex.Unlock()
+		return
+	default:
+		return
+	}
+	if !b.AutoJoinInvites || !b.isAllowedInviter(ev.Sender) {
+		return
+	}
+
+	b.joiningMutex.Lock()
+	if b.joining[ev.RoomID] {
+		b.joiningMutex.Unlock()
+		return
+	}
+	b.joining[ev.RoomID] = true
+	b.joiningMutex.Unlock()
+
+	b.syncCtxMutex.Lock()
+	ctx := b.syncCtx
+	b.syncCtxMutex.Unlock()
+	go b.join(ctx, ev.RoomID, ev.Sender)
+}
+
+// join joins a room the bot was invited to, and reports the outcome to OnJoin or OnJoinError.
+func (b *Bot) join(ctx context.Context, roomID, inviter string) {
+	if _, err := b.Client.JoinRoom(ctx, roomID, "", nil); err != nil {
+		b.joiningMutex.Lock()
+		delete(b.joining, roomID)
+		b.joiningMutex.Unlock()
+		if b.OnJoinError != nil {
+			b.OnJoinError(roomID, inviter, err)
+		}
+		return
+	}
+	if b.OnJoin != nil {
+		b.OnJoin(roomID, inviter)
+	}
+}
+
+func (b *Bot) isAllowedInviter(userID string) bool {
+	if len(b.AllowedInviters) == 0 {
+		return true
+	}
+	for _, allowed := range b.AllowedInviters {
+		if allowed == userID {
+			return true
+		}
+	}
+	return false
+}
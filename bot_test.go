@@ -0,0 +1,107 @@
+package gomatrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+const testInviteSync = `{
+  "next_batch": "s2",
+  "rooms": {
+    "invite": {
+      "%s": {
+        "invite_state": {
+          "events": [
+            {
+              "type": "m.room.member",
+              "sender": "%s",
+              "state_key": "@user:test.gomatrix.org",
+              "content": {"membership": "invite"}
+            }
+          ]
+        }
+      }
+    }
+  }
+}`
+
+func TestBot_AutoJoinInvites(t *testing.T) {
+	var joins []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" {
+			joins = append(joins, req.URL.Path)
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	bot, err := NewBot(cli)
+	if err != nil {
+		t.Fatalf("NewBot: error, got %s", err.Error())
+	}
+	bot.AutoJoinInvites = true
+	bot.AllowedInviters = []string{"@friend:bar"}
+	joined := make(chan string, 2)
+	bot.OnJoin = func(roomID, inviter string) {
+		joined <- roomID
+	}
+
+	process := func(roomID, inviter string) {
+		var res RespSync
+		if err := json.Unmarshal([]byte(fmt.Sprintf(testInviteSync, roomID, inviter)), &res); err != nil {
+			t.Fatalf("failed to unmarshal sync response: %s", err)
+		}
+		if err := cli.Syncer.ProcessResponse(&res, "s1"); err != nil {
+			t.Fatalf("ProcessResponse: error, got %s", err)
+		}
+	}
+	process("!foo:bar", "@friend:bar")
+	process("!foo:bar", "@friend:bar") // duplicate invite must not be joined twice
+	process("!spam:bar", "@stranger:bar")
+
+	if roomID := <-joined; roomID != "!foo:bar" {
+		t.Fatalf("OnJoin: got %s, want !foo:bar", roomID)
+	}
+	if len(joins) != 1 || joins[0] != "/_matrix/client/r0/join/!foo:bar" {
+		t.Fatalf("AutoJoinInvites: got joins %v, want exactly one join of !foo:bar", joins)
+	}
+
+	// Once the bot has left the room, a new invite to it is accepted again.
+	var res RespSync
+	err = json.Unmarshal([]byte(`{
+  "next_batch": "s3",
+  "rooms": {
+    "leave": {
+      "!foo:bar": {
+        "timeline": {
+          "events": [
+            {
+              "type": "m.room.member",
+              "sender": "@friend:bar",
+              "state_key": "@user:test.gomatrix.org",
+              "content": {"membership": "leave"}
+            }
+          ]
+        }
+      }
+    }
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+	if err = cli.Syncer.ProcessResponse(&res, "s2"); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	process("!foo:bar", "@friend:bar")
+	<-joined
+	if len(joins) != 2 {
+		t.Fatalf("AutoJoinInvites: got joins %v, want !foo:bar to be joined again after leaving", joins)
+	}
+}
@@ -4,10 +4,14 @@
 package gomatrix
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,20 +19,39 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"path"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// userAgent is the default User-Agent header. It includes the version of this module when the binary was built
+// with it as a versioned dependency, e.g. "gomatrix/v0.1.0", and is just "gomatrix" otherwise.
+var userAgent = func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "gomatrix"
+	}
+	for _, mod := range append([]*debug.Module{&info.Main}, info.Deps...) {
+		if mod.Path == "github.com/globekeeper/gomatrix" && mod.Version != "" && mod.Version != "(devel)" {
+			return "gomatrix/" + mod.Version
+		}
+	}
+	return "gomatrix"
+}()
+
 // Client represents a Matrix client.
 type Client struct {
 	HomeserverURL *url.URL     // The base homeserver URL
 	Prefix        string       // The API prefix eg '/_matrix/client/r0'
+	MediaPrefix   string       // The media API prefix eg '/_matrix/media/r0'. If empty, '/_matrix/media/r0' is used.
 	UserID        string       // The user ID of the client. Used for forming HTTP paths which use the client's user ID.
 	AccessToken   string       // The access_token for the client.
-	Client        *http.Client // The underlying HTTP client which will be used to make HTTP requests.
+	Client        *http.Client // The underlying HTTP client which will be used to make HTTP requests. NewClient sets a dedicated client, see SetTransport.
 	Syncer        Syncer       // The thing which can process /sync responses
 	Store         Storer       // The thing which can store rooms/tokens/ids
 
@@ -37,10 +60,70 @@ type Client struct {
 	// See http://matrix.org/docs/spec/application_service/unstable.html#identity-assertion
 	AppServiceUserID string
 
-	syncingMutex           sync.Mutex // protects syncingID
-	syncingID              uint32     // Identifies the current Sync. Only one Sync can be active at any given time.
-	RandomizeXForwardedFor bool       // If true, client will add a random IP as a X-Forwarded-For header. Used to bypass rate limiting in tests. rand.Seed() is not called.
-}
+	// If set, Sync sends this filter JSON inline in the filter query parameter of every /sync request instead of
+	// creating a filter with CreateFilter and storing its ID, saving a round-trip and any persistence. As the filter
+	// is part of the URL, keep it small: many homeservers and reverse proxies reject URLs longer than around 8KB.
+	InlineFilter json.RawMessage
+
+	// Headers added to every request made to the homeserver, e.g. for authenticating proxies or a custom
+	// User-Agent. They are applied after the headers set by the client itself, so setting Authorization or
+	// Content-Type here replaces the client's own value, except for the Content-Type of media uploads.
+	DefaultHeaders http.Header
+
+	// If set, requests made with a context that has no deadline time out after this duration. Contexts which
+	// already have a deadline are used as they are. /sync requests are exempt as they long-poll.
+	RequestTimeout time.Duration
+
+	// If set, JSON responses with a body larger than this many bytes fail with ErrResponseTooLarge instead of
+	// being read into memory. 0 means no limit. Media downloads are not limited.
+	MaxResponseBytes int64
+
+	// If true, media downloads ask the homeserver not to compress the response with Accept-Encoding: identity, so
+	// the bytes returned are exactly those stored, without relying on the transport's transparent gzip decompression.
+	// A download is rejected if the response is compressed anyway. JSON requests are not affected and are still
+	// decompressed transparently.
+	DisableMediaCompression bool
+
+	// If true, JSON responses which contain fields that the response type doesn't have fail to decode, rather than
+	// the fields being ignored. This is meant for development, to notice when the homeserver returns fields which
+	// aren't modelled yet. It only applies to decoding successful responses, not to requests or Matrix errors.
+	StrictJSON bool
+
+	// If set, called after every request made with MakeRequest or MakeFullRequest, e.g. to log requests or collect
+	// metrics. reqBody and respBody are the raw JSON bodies, truncated to OnRequestMaxBodyBytes, and status is 0 if
+	// no response was received. Headers are not passed, so the access token in the Authorization header is never
+	// exposed, and an access_token query parameter is redacted from url, as are access_token, refresh_token and
+	// password keys at any depth of a JSON body. It is called on the requesting goroutine, so it should not block.
+	OnRequest func(method, url string, reqBody, respBody []byte, status int, err error)
+	// The number of bytes of each body passed to OnRequest. 0 uses DefaultOnRequestMaxBodyBytes and a negative
+	// value passes bodies in full.
+	OnRequestMaxBodyBytes int
+
+	// If true, KickUser and BanUser first fetch the power levels of the room and fail with a *PermissionError, without
+	// sending the request, if the client's user isn't allowed to kick or ban the target. This costs an extra request.
+	PrecheckPermissions bool
+
+	// If set, KickUser and BanUser send this reason when the request doesn't have one.
+	DefaultModerationReason string
+
+	// If set, called by Sync after every successful /sync request with the new next_batch token and how long the
+	// request took. Useful for emitting metrics. It is called on the syncing goroutine, so it should not block.
+	OnSyncSuccess func(nextBatch string, duration time.Duration)
+
+	// If set, called by Sync after Syncer.ProcessResponse has successfully processed a /sync response. isInitial is
+	// true for the response to the initial sync, made without a since token, after which the client has caught up and
+	// can e.g. announce itself as online. It is called on the syncing goroutine, so it should not block.
+	OnSyncComplete func(isInitial bool)
+
+	syncingMutex           sync.Mutex         // protects syncingID and syncCancel
+	syncingID              uint32             // Identifies the current Sync. Only one Sync can be active at any given time.
+	syncCancel             context.CancelFunc // Cancels the context of the current Sync.
+	syncFailures           int32              // Number of consecutive failed /sync requests. Accessed atomically.
+	RandomizeXForwardedFor bool               // If true, client will add a random IP as a X-Forwarded-For header. Used to bypass rate limiting in tests. rand.Seed() is not called.
+}
+
+// DefaultOnRequestMaxBodyBytes is the number of bytes of each body passed to Client.OnRequest by default.
+const DefaultOnRequestMaxBodyBytes = 4096
 
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
 type HTTPError struct {
@@ -62,24 +145,72 @@ func (e HTTPError) Error() string {
 	return fmt.Sprintf("http request failed: code: %d method: %s path: %s err: %v", e.Code, e.Method, e.Path, err)
 }
 
-// BuildURL builds a URL with the Client's homeserver/prefix set already.
+// BuildURL builds a URL with the Client's homeserver/prefix set already. Each path segment is percent-encoded,
+// so IDs and aliases containing reserved characters such as '#', '?' or '/' can be passed as they are.
+// As a '/' within a segment is encoded too, a multi-part path must be passed as separate segments, e.g.
+// BuildURL("logout", "all") rather than BuildURL("logout/all"), which would build ".../logout%2Fall".
 func (cli *Client) BuildURL(urlPath ...string) string {
-	ps := append([]string{cli.Prefix}, urlPath...)
-	return cli.BuildBaseURL(ps...)
+	return cli.buildURL(cli.Prefix, urlPath)
+}
+
+// BuildMediaURL builds a URL with the Client's homeserver/media prefix set already. Path segments are
+// percent-encoded as in BuildURL.
+func (cli *Client) BuildMediaURL(urlPath ...string) string {
+	prefix := cli.MediaPrefix
+	if prefix == "" {
+		prefix = "/_matrix/media/r0"
+	}
+	return cli.buildURL(prefix, urlPath)
 }
 
+// SetAPIVersion sets Prefix and MediaPrefix to the given version of the client-server and media APIs, e.g. "v3".
+// NewClient defaults to "r0", which newer homeservers may no longer serve.
+// Endpoints which only exist in a different version, such as the v1 endpoints, are not affected.
+func (cli *Client) SetAPIVersion(version string) error {
+	if !apiVersionRegex.MatchString(version) {
+		return fmt.Errorf("invalid API version %q: must be r0 or vN", version)
+	}
+	cli.Prefix = "/_matrix/client/" + version
+	cli.MediaPrefix = "/_matrix/media/" + version
+	return nil
+}
+
+var apiVersionRegex = regexp.MustCompile(`^(r0|v[0-9]+)$`)
+
 // BuildBaseURL builds a URL with the Client's homeserver set already. You must
-// supply the prefix in the path.
+// supply the prefix in the path. Unlike BuildURL, a '/' in a path segment is
+// treated as a path separator, but other reserved characters are percent-encoded.
 func (cli *Client) BuildBaseURL(urlPath ...string) string {
+	var segments []string
+	for _, p := range urlPath {
+		segments = append(segments, strings.Split(p, "/")...)
+	}
+	return cli.buildURL("", segments)
+}
+
+// buildURL builds a URL from the homeserver URL, the already-escaped prefix and the path segments, which are
+// percent-encoded. Empty segments are skipped, except that an empty last segment, such as the empty state key in
+// rooms/{roomId}/state/{eventType}/, adds a trailing slash.
+func (cli *Client) buildURL(prefix string, segments []string) string {
 	// copy the URL. Purposefully ignore error as the input is from a valid URL already
 	hsURL, _ := url.Parse(cli.HomeserverURL.String())
-	parts := []string{hsURL.Path}
-	parts = append(parts, urlPath...)
-	hsURL.Path = path.Join(parts...)
-	// Manually add the trailing slash back to the end of the path if it's explicitly needed
-	if strings.HasSuffix(urlPath[len(urlPath)-1], "/") {
-		hsURL.Path = hsURL.Path + "/"
+	var escaped []string
+	for _, p := range strings.Split(hsURL.EscapedPath()+"/"+prefix, "/") {
+		if p != "" {
+			escaped = append(escaped, p)
+		}
+	}
+	for _, p := range segments {
+		if p != "" {
+			escaped = append(escaped, url.PathEscape(p))
+		}
+	}
+	rawPath := "/" + strings.Join(escaped, "/")
+	if len(segments) > 0 && segments[len(segments)-1] == "" && len(escaped) > 0 {
+		rawPath += "/"
 	}
+	hsURL.Path, _ = url.PathUnescape(rawPath)
+	hsURL.RawPath = rawPath
 	query := hsURL.Query()
 	if cli.AppServiceUserID != "" {
 		query.Set("user_id", cli.AppServiceUserID)
@@ -90,10 +221,25 @@ func (cli *Client) BuildBaseURL(urlPath ...string) string {
 
 // BuildURLWithQuery builds a URL with query parameters in addition to the Client's homeserver/prefix set already.
 func (cli *Client) BuildURLWithQuery(urlPath []string, urlQuery map[string]string) string {
-	u, _ := url.Parse(cli.BuildURL(urlPath...))
-	q := u.Query()
+	values := make(url.Values, len(urlQuery))
 	for k, v := range urlQuery {
-		q.Set(k, v)
+		values.Set(k, v)
+	}
+	return cli.BuildURLWithValues(urlPath, values)
+}
+
+// BuildURLWithValues builds a URL with query parameters in addition to the Client's homeserver/prefix set already.
+// Unlike BuildURLWithQuery, a parameter may be repeated, e.g. server_name for JoinRoomVia.
+func (cli *Client) BuildURLWithValues(urlPath []string, values url.Values) string {
+	return withQuery(cli.BuildURL(urlPath...), values)
+}
+
+// withQuery adds values to the query of rawURL, replacing any existing values with the same keys.
+func withQuery(rawURL string, values url.Values) string {
+	u, _ := url.Parse(rawURL)
+	q := u.Query()
+	for k, v := range values {
+		q[k] = v
 	}
 	u.RawQuery = q.Encode()
 	return u.String()
@@ -117,35 +263,56 @@ func (cli *Client) ClearCredentials() {
 // This function will block until a fatal /sync error occurs, so it should almost always be started as a new goroutine.
 // Fatal sync errors can be caused by:
 //   - The failure to create a filter.
-//   - Client.Syncer.OnFailedSync returning an error in response to a failed sync.
+//   - Client.Syncer.OnFailedSync returning an error in response to a failed sync. The DefaultSyncer does this
+//     when the access token is no longer valid, see IsFatalSyncError.
 //   - Client.Syncer.ProcessResponse returning an error.
 //
 // If you wish to continue retrying in spite of these fatal errors, call Sync() again.
+//
+// If ctx is cancelled, the in-flight /sync request is aborted and Sync returns ctx.Err() straight away, without
+// waiting for the long-poll to finish or the Syncer to be told about a failed sync.
 func (cli *Client) Sync(ctx context.Context) error {
 	// Mark the client as syncing.
 	// We will keep syncing until the syncing state changes. Either because
-	// Sync is called or StopSync is called.
-	syncingID := cli.incrementSyncingID()
+	// Sync is called or StopSync is called, which also cancel syncCtx to abort the in-flight request.
+	syncCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	syncingID := cli.incrementSyncingID(cancel)
+	// stopped returns the error to return once syncCtx is done: nil if the sync was stopped, or ctx.Err().
+	stopped := func() error {
+		if cli.getSyncingID() != syncingID {
+			return nil
+		}
+		return ctx.Err()
+	}
 	nextBatch := cli.Store.LoadNextBatch(cli.UserID)
-	filterID := cli.Store.LoadFilterID(cli.UserID)
-	if filterID == "" {
-		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
-		resFilter, err := cli.CreateFilter(ctx, filterJSON)
-		if err != nil {
-			return err
+	syncFilter, err := cli.syncFilter(syncCtx)
+	if err != nil {
+		if syncCtx.Err() != nil {
+			return stopped()
 		}
-		filterID = resFilter.FilterID
-		cli.Store.SaveFilterID(cli.UserID, filterID)
+		return err
 	}
 
 	for {
-		resSync, err := cli.SyncRequest(ctx, 30000, nextBatch, "91", false, "")
+		if syncCtx.Err() != nil {
+			return stopped()
+		}
+		start := time.Now()
+		resSync, err := cli.SyncRequest(syncCtx, 30000, nextBatch, syncFilter, false, "")
 		if err != nil {
+			if syncCtx.Err() != nil {
+				// The request failed because the sync was stopped or ctx is done, which isn't a sync failure.
+				return stopped()
+			}
+			atomic.AddInt32(&cli.syncFailures, 1)
 			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
 			if err2 != nil {
 				return err2
 			}
-			time.Sleep(duration)
+			if sleepContext(syncCtx, duration) != nil {
+				return stopped()
+			}
 			continue
 		}
 
@@ -156,6 +323,11 @@ func (cli *Client) Sync(ctx context.Context) error {
 			return nil
 		}
 
+		atomic.StoreInt32(&cli.syncFailures, 0)
+		if cli.OnSyncSuccess != nil {
+			cli.OnSyncSuccess(resSync.NextBatch, time.Since(start))
+		}
+
 		// Save the token now *before* processing it. This means it's possible
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
@@ -163,14 +335,45 @@ func (cli *Client) Sync(ctx context.Context) error {
 		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
 			return err
 		}
+		if cli.OnSyncComplete != nil {
+			cli.OnSyncComplete(nextBatch == "")
+		}
 
 		nextBatch = resSync.NextBatch
 	}
 }
 
-func (cli *Client) incrementSyncingID() uint32 {
+// syncFilter returns the filter to send with each /sync request: the compacted InlineFilter if it is set, otherwise
+// the ID of the filter saved in Store. If there is none, a filter is created from Syncer.GetFilterJSON and saved.
+func (cli *Client) syncFilter(ctx context.Context) (string, error) {
+	if len(cli.InlineFilter) > 0 {
+		// Compact the filter as it is sent in the URL of every request.
+		buf := new(bytes.Buffer)
+		if err := json.Compact(buf, cli.InlineFilter); err != nil {
+			return "", fmt.Errorf("invalid inline filter: %w", err)
+		}
+		return buf.String(), nil
+	}
+	if filterID := cli.Store.LoadFilterID(cli.UserID); filterID != "" {
+		return filterID, nil
+	}
+	resFilter, err := cli.CreateFilter(ctx, cli.Syncer.GetFilterJSON(cli.UserID))
+	if err != nil {
+		return "", err
+	}
+	cli.Store.SaveFilterID(cli.UserID, resFilter.FilterID)
+	return resFilter.FilterID, nil
+}
+
+// incrementSyncingID stops the current Sync, if any, by advancing syncingID and cancelling its context. cancel is the
+// context.CancelFunc of the new Sync, or nil if no Sync is starting.
+func (cli *Client) incrementSyncingID(cancel context.CancelFunc) uint32 {
 	cli.syncingMutex.Lock()
 	defer cli.syncingMutex.Unlock()
+	if cli.syncCancel != nil {
+		cli.syncCancel()
+	}
+	cli.syncCancel = cancel
 	cli.syncingID++
 	return cli.syncingID
 }
@@ -181,10 +384,17 @@ func (cli *Client) getSyncingID() uint32 {
 	return cli.syncingID
 }
 
-// StopSync stops the ongoing sync started by Sync.
+// ConsecutiveSyncFailures returns the number of /sync requests made by Sync which have failed in a row. It is reset
+// to 0 by the next successful request.
+func (cli *Client) ConsecutiveSyncFailures() int {
+	return int(atomic.LoadInt32(&cli.syncFailures))
+}
+
+// StopSync stops the ongoing sync started by Sync. The in-flight /sync request is cancelled, so Sync returns nil
+// promptly rather than after the long-poll times out.
 func (cli *Client) StopSync() {
 	// Advance the syncing state so that any running Syncs will terminate.
-	cli.incrementSyncingID()
+	cli.incrementSyncingID(nil)
 }
 
 // MakeRequest makes a JSON HTTP request to the given URL.
@@ -194,21 +404,73 @@ func (cli *Client) StopSync() {
 // Returns an error if the response is not 2xx along with the HTTP body bytes if it got that far. This error is
 // an HTTPError which includes the returned HTTP status code, byte contents of the response body and possibly a
 // RespError as the WrappedError, if the HTTP body could be decoded as a RespError.
+//
+// If ctx has no deadline and RequestTimeout is set, the request times out after RequestTimeout.
 func (cli *Client) MakeRequest(ctx context.Context, method string, httpURL string, reqBody interface{}, resBody interface{}) error {
+	_, _, err := cli.MakeFullRequest(ctx, FullRequest{
+		Method:       method,
+		URL:          httpURL,
+		RequestJSON:  reqBody,
+		ResponseJSON: resBody,
+	})
+	return err
+}
+
+// FullRequest holds the parameters of MakeFullRequest.
+type FullRequest struct {
+	Method string
+	URL    string
+	// The value to encode as the JSON request body, or nil for no body.
+	RequestJSON interface{}
+	// If not nil, a 2xx response body is decoded into this value.
+	ResponseJSON interface{}
+}
+
+// MakeFullRequest is like MakeRequest, but also returns the HTTP response and its raw body, so that callers can
+// inspect the status code and headers such as ETag or Location. The response body has already been read and closed
+// when it is returned. On a non-2xx response, the response and body are returned along with the HTTPError.
+func (cli *Client) MakeFullRequest(ctx context.Context, params FullRequest) (*http.Response, []byte, error) {
+	if _, ok := ctx.Deadline(); !ok && cli.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cli.RequestTimeout)
+		defer cancel()
+	}
+	return cli.makeFullRequest(ctx, params)
+}
+
+// makeRequest is MakeRequest without RequestTimeout, for long-polling requests.
+func (cli *Client) makeRequest(ctx context.Context, method string, httpURL string, reqBody interface{}, resBody interface{}) error {
+	_, _, err := cli.makeFullRequest(ctx, FullRequest{
+		Method:       method,
+		URL:          httpURL,
+		RequestJSON:  reqBody,
+		ResponseJSON: resBody,
+	})
+	return err
+}
+
+func (cli *Client) makeFullRequest(ctx context.Context, params FullRequest) (res *http.Response, contents []byte, err error) {
+	var reqBody []byte
+	if cli.OnRequest != nil {
+		defer func() {
+			cli.logRequest(params, reqBody, res, contents, err)
+		}()
+	}
+
 	var req *http.Request
-	var err error
-	if reqBody != nil {
+	if params.RequestJSON != nil {
 		buf := new(bytes.Buffer)
-		if err := json.NewEncoder(buf).Encode(reqBody); err != nil {
-			return err
+		if err = json.NewEncoder(buf).Encode(params.RequestJSON); err != nil {
+			return nil, nil, err
 		}
-		req, err = http.NewRequestWithContext(ctx, method, httpURL, buf)
+		reqBody = buf.Bytes()
+		req, err = http.NewRequestWithContext(ctx, params.Method, params.URL, buf)
 	} else {
-		req, err = http.NewRequestWithContext(ctx, method, httpURL, nil)
+		req, err = http.NewRequestWithContext(ctx, params.Method, params.URL, nil)
 	}
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -222,23 +484,174 @@ func (cli *Client) MakeRequest(ctx context.Context, method string, httpURL strin
 		binary.LittleEndian.PutUint32(buf, ip)
 		req.Header.Set("X-Forwarded-For", net.IP(buf).String())
 	}
+	cli.applyDefaultHeaders(req)
 
-	res, err := cli.Client.Do(req)
+	res, err = cli.Client.Do(req)
 	if res != nil {
 		defer res.Body.Close()
 	}
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if res.Body == nil {
+		res.Body = http.NoBody
+	}
+	if cli.MaxResponseBytes > 0 {
+		res.Body = &maxBytesReader{r: res.Body, n: cli.MaxResponseBytes}
 	}
 	if res.StatusCode/100 != 2 { // not 2xx
-		return respToHttpErr(res, req, method)
+		httpErr := respToHttpErr(res, req, params.Method)
+		return res, httpErr.Contents, httpErr
 	}
 
-	if resBody != nil && res.Body != nil {
-		return json.NewDecoder(res.Body).Decode(&resBody)
+	contents, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res, contents, err
 	}
+	if params.ResponseJSON != nil {
+		if err = cli.decodeJSON(contents, params.ResponseJSON); err != nil {
+			return res, contents, err
+		}
+	}
+	return res, contents, nil
+}
 
-	return nil
+// logRequest calls OnRequest with the outcome of a request made by makeFullRequest.
+func (cli *Client) logRequest(params FullRequest, reqBody []byte, res *http.Response, resBody []byte, err error) {
+	status := 0
+	if res != nil {
+		status = res.StatusCode
+	}
+	maxBytes := cli.OnRequestMaxBodyBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultOnRequestMaxBodyBytes
+	}
+	truncate := func(b []byte) []byte {
+		if maxBytes > 0 && len(b) > maxBytes {
+			return b[:maxBytes]
+		}
+		return b
+	}
+	cli.OnRequest(params.Method, redactURL(params.URL), truncate(redactBody(reqBody)), truncate(redactBody(resBody)), status, err)
+}
+
+// redactedBodyKeys are the keys of JSON bodies whose values are replaced by redactBody.
+var redactedBodyKeys = map[string]bool{
+	"access_token":  true,
+	"refresh_token": true,
+	"password":      true,
+}
+
+// redactBody replaces the values of redactedBodyKeys at any depth of a JSON body. Bodies without any such key,
+// including those which aren't JSON, are returned unchanged.
+func redactBody(body []byte) []byte {
+	if !bytes.Contains(body, []byte("_token")) && !bytes.Contains(body, []byte("password")) {
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if dec.Decode(&v) != nil || !redactValue(v) {
+		return body
+	}
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// redactValue redacts v in place, returning true if anything was redacted.
+func redactValue(v interface{}) bool {
+	redacted := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if _, ok := child.(string); ok && redactedBodyKeys[k] {
+				v[k] = "REDACTED"
+				redacted = true
+			} else if redactValue(child) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if redactValue(child) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+// redactURL replaces the value of any access_token query parameter in rawURL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	if _, ok := q["access_token"]; !ok {
+		return rawURL
+	}
+	q.Set("access_token", "REDACTED")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// decodeJSON decodes a response body into out, rejecting unknown fields if StrictJSON is set.
+func (cli *Client) decodeJSON(contents []byte, out interface{}) error {
+	if !cli.StrictJSON {
+		return json.Unmarshal(contents, out)
+	}
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
+
+// applyDefaultHeaders sets the User-Agent and then copies DefaultHeaders onto req, replacing any existing values.
+func (cli *Client) applyDefaultHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent)
+	for k, values := range cli.DefaultHeaders {
+		req.Header.Del(k)
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+}
+
+// maxBytesReader reads at most n bytes from r and then fails with ErrResponseTooLarge if there is more to read.
+type maxBytesReader struct {
+	r   io.ReadCloser
+	n   int64
+	err error
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Read one byte more than allowed so that a body of exactly n bytes is not an error.
+	if int64(len(p))-1 > m.n {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	if int64(n) <= m.n {
+		m.n -= int64(n)
+		m.err = err
+		return n, err
+	}
+	n = int(m.n)
+	m.n = 0
+	m.err = ErrResponseTooLarge
+	return n, m.err
+}
+
+func (m *maxBytesReader) Close() error {
+	return m.r.Close()
 }
 
 func respToHttpErr(res *http.Response, req *http.Request, method string) *HTTPError {
@@ -258,6 +671,12 @@ func respToHttpErr(res *http.Response, req *http.Request, method string) *HTTPEr
 		httpErr.WrappedError = fmt.Errorf("upload request failed: failed to unmarshall response: %w", err)
 		return httpErr
 	}
+	// Fall back to the Retry-After header (in seconds) if the body didn't say how long to wait.
+	if httpErr.MatrixError.RetryAfterMs == 0 {
+		if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && secs > 0 {
+			httpErr.MatrixError.RetryAfterMs = secs * 1000
+		}
+	}
 	httpErr.WrappedError = fmt.Errorf("request failed: method: %s path: %s body: %s", method, req.URL.Path, contents)
 	return httpErr
 }
@@ -269,7 +688,34 @@ func (cli *Client) CreateFilter(ctx context.Context, filter json.RawMessage) (re
 	return
 }
 
+// CreateFilterFromStruct validates and uploads a typed Filter. See CreateFilter.
+func (cli *Client) CreateFilterFromStruct(ctx context.Context, filter Filter) (*RespCreateFilter, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	return cli.CreateFilter(ctx, filterJSON)
+}
+
+// GetFilter downloads a filter previously created with CreateFilter. If the filter no longer exists, the returned
+// error matches ErrNotFound, which can be used to decide to create it again:
+//
+//	if errors.Is(err, gomatrix.ErrNotFound) {
+//		// recreate the filter
+//	}
+//
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-user-userid-filter-filterid
+func (cli *Client) GetFilter(ctx context.Context, userID, filterID string) (filter json.RawMessage, err error) {
+	urlPath := cli.BuildURL("user", userID, "filter", filterID)
+	err = cli.MakeRequest(ctx, "GET", urlPath, nil, &filter)
+	return
+}
+
 // SyncRequest makes an HTTP request according to http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-sync
+// filterID may be either the ID of a filter created with CreateFilter or a filter JSON object.
 func (cli *Client) SyncRequest(ctx context.Context, timeout int, since, filterID string, fullState bool, setPresence string) (resp *RespSync, err error) {
 	query := map[string]string{
 		"timeout": strconv.Itoa(timeout),
@@ -287,21 +733,44 @@ func (cli *Client) SyncRequest(ctx context.Context, timeout int, since, filterID
 		query["full_state"] = "true"
 	}
 	urlPath := cli.BuildURLWithQuery([]string{"sync"}, query)
-	err = cli.MakeRequest(ctx, "GET", urlPath, nil, &resp)
+	err = cli.makeRequest(ctx, "GET", urlPath, nil, &resp)
 	return
 }
 
+// ForceFullSync makes a single /sync request without a since token and with full_state set, ignoring the next_batch
+// token saved in Store, and returns the response without processing it. This gives a fresh snapshot of the state of
+// every room, e.g. to rebuild local state after detecting that it is out of sync. The filter is the same as Sync's,
+// so a filter is created and saved first if Sync hasn't done so yet.
+func (cli *Client) ForceFullSync(ctx context.Context) (*RespSync, error) {
+	filter, err := cli.syncFilter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cli.SyncRequest(ctx, 0, "", filter, true, "")
+}
+
 func (cli *Client) register(ctx context.Context, u string, req *ReqRegister) (resp *RespRegister, uiaResp *RespUserInteractive, err error) {
-	err = cli.MakeRequest(ctx, "POST", u, req, &resp)
+	uiaResp, err = cli.makeUIARequest(ctx, "POST", u, req, &resp)
+	return
+}
+
+// makeUIARequest makes a request to an endpoint protected by user-interactive authentication. If the homeserver
+// responds with 401 and a body listing flows or a session, it is returned as a RespUserInteractive so the caller can
+// complete a stage and retry, and err is nil.
+func (cli *Client) makeUIARequest(ctx context.Context, method, u string, reqBody, resBody interface{}) (uiaResp *RespUserInteractive, err error) {
+	err = cli.MakeRequest(ctx, method, u, reqBody, resBody)
 	if err != nil {
 		httpErr, ok := err.(*HTTPError)
 		if !ok { // network error
 			return
 		}
 		if httpErr.Code == 401 {
-			// body should be RespUserInteractive, if it isn't, fail with the error
-			err = json.Unmarshal(httpErr.Contents, &uiaResp)
-			return
+			// Only a body with flows or a session is a UIA response. Any other 401, such as M_UNKNOWN_TOKEN, is
+			// returned as the HTTPError.
+			var resp RespUserInteractive
+			if json.Unmarshal(httpErr.Contents, &resp) == nil && (len(resp.Flows) > 0 || resp.Session != "") {
+				return &resp, nil
+			}
 		}
 	}
 	return
@@ -371,6 +840,61 @@ func (cli *Client) Login(ctx context.Context, req *ReqLogin) (resp *RespLogin, e
 	return
 }
 
+// LoginWithPassword logs in with an m.login.password login, identifying the user with an m.id.user identifier
+// rather than the deprecated top-level user field. user may be a full user ID or just its localpart. If deviceID is
+// empty, the homeserver creates a new device. To log in with an email address or phone number instead, call Login
+// with a ThirdpartyIdentifier or PhoneIdentifier.
+// This does not set credentials on this client instance. See SetCredentials() instead.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#password-based
+func (cli *Client) LoginWithPassword(ctx context.Context, user, password, deviceID string) (*RespLogin, error) {
+	return cli.Login(ctx, &ReqLogin{
+		Type:       "m.login.password",
+		Identifier: NewUserIdentifier(user),
+		Password:   password,
+		DeviceID:   deviceID,
+	})
+}
+
+// LoginWithToken logs in with an m.login.token login token, such as the loginToken passed to the redirect URL at the
+// end of SSO login, see SSORedirectURL. If deviceID is empty, the homeserver creates a new device.
+// This does not set credentials on this client instance. See SetCredentials() instead.
+// See https://spec.matrix.org/v1.3/client-server-api/#token-based
+func (cli *Client) LoginWithToken(ctx context.Context, token, deviceID string) (*RespLogin, error) {
+	return cli.Login(ctx, &ReqLogin{
+		Type:     "m.login.token",
+		Token:    token,
+		DeviceID: deviceID,
+	})
+}
+
+// GetLoginFlows returns the login types supported by the homeserver. See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3login
+func (cli *Client) GetLoginFlows(ctx context.Context) (resp *RespLoginFlows, err error) {
+	urlPath := cli.BuildURL("login")
+	err = cli.MakeRequest(ctx, "GET", urlPath, nil, &resp)
+	return
+}
+
+// SSORedirectURL returns the URL to send the user's browser to in order to start SSO login. Once the user has
+// authenticated, the homeserver redirects back to redirectURL with a loginToken query parameter.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3loginssoredirect
+func (cli *Client) SSORedirectURL(redirectURL string) string {
+	return cli.BuildURLWithQuery([]string{"login", "sso", "redirect"}, map[string]string{
+		"redirectUrl": redirectURL,
+	})
+}
+
+// RefreshToken exchanges a refresh token for a new access token according to https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+// The old refresh token is invalidated once the new access token is used, so the returned RefreshToken must replace it.
+// This does not set credentials on this client instance. See SetCredentials() instead.
+//
+// The endpoint only exists in v3 of the client-server API, so it is requested under /_matrix/client/v3 whatever
+// Prefix is set to.
+func (cli *Client) RefreshToken(ctx context.Context, refreshToken string) (resp *RespRefresh, err error) {
+	urlPath := cli.buildURL("/_matrix/client/v3", []string{"refresh"})
+	err = cli.MakeRequest(ctx, "POST", urlPath, &ReqRefresh{RefreshToken: refreshToken}, &resp)
+	return
+}
+
 // Logout the current user. See http://matrix.org/docs/spec/client_server/r0.6.0.html#post-matrix-client-r0-logout
 // This does not clear the credentials from the client instance. See ClearCredentials() instead.
 func (cli *Client) Logout(ctx context.Context) (resp *RespLogout, err error) {
@@ -382,7 +906,7 @@ func (cli *Client) Logout(ctx context.Context) (resp *RespLogout, err error) {
 // LogoutAll logs the current user out on all devices. See https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-logout-all
 // This does not clear the credentials from the client instance. See ClearCredentails() instead.
 func (cli *Client) LogoutAll(ctx context.Context) (resp *RespLogoutAll, err error) {
-	urlPath := cli.BuildURL("logout/all")
+	urlPath := cli.BuildURL("logout", "all")
 	err = cli.MakeRequest(ctx, "POST", urlPath, nil, &resp)
 	return
 }
@@ -394,6 +918,14 @@ func (cli *Client) Versions(ctx context.Context) (resp *RespVersions, err error)
 	return
 }
 
+// Ping checks that the homeserver is reachable by requesting the unauthenticated /versions endpoint. It returns nil
+// if the homeserver responds with a 2xx status, or the error otherwise, which is an HTTPError if the homeserver
+// responded with another status. Useful as a liveness probe which does not need valid credentials.
+func (cli *Client) Ping(ctx context.Context) error {
+	_, err := cli.Versions(ctx)
+	return err
+}
+
 // PublicRooms returns the list of public rooms on target server. See https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-unstable-publicrooms
 func (cli *Client) PublicRooms(ctx context.Context, limit int, since string, server string) (resp *RespPublicRooms, err error) {
 	args := map[string]string{}
@@ -441,6 +973,78 @@ func (cli *Client) PublicRoomsFiltered(ctx context.Context, limit int, since str
 	return
 }
 
+// RoomSummary returns a preview of a room which the user may not have joined yet, e.g. to display an invite or a
+// space child. via is the list of servers to ask if the homeserver is not in the room.
+//
+// The stable endpoint is tried first, followed by the unstable MSC3266 endpoint. If the homeserver supports neither,
+// the first 10 pages of the public room directory of the first via server (or the homeserver if via is empty) are
+// searched instead, which only works for published rooms.
+// See https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+func (cli *Client) RoomSummary(ctx context.Context, roomIDorAlias string, via []string) (resp *RespRoomSummary, err error) {
+	query := url.Values{"via": via}
+	for _, u := range []string{
+		cli.buildURL("/_matrix/client/v1", []string{"room_summary", roomIDorAlias}),
+		cli.buildURL("/_matrix/client/unstable/im.nheko.summary", []string{"rooms", roomIDorAlias, "summary"}),
+	} {
+		resp = nil
+		err = cli.MakeRequest(ctx, "GET", withQuery(u, query), nil, &resp)
+		if !isUnsupportedEndpoint(err) {
+			return
+		}
+	}
+	return cli.roomSummaryFromDirectory(ctx, roomIDorAlias, via, err)
+}
+
+// roomSummaryMaxDirectoryPages is the number of pages of the public room directory searched by RoomSummary, so
+// that looking up an unpublished room on a server with a large directory doesn't page through all of it.
+const roomSummaryMaxDirectoryPages = 10
+
+// roomSummaryFromDirectory pages through the public room directory looking for the room. If it is not found within
+// roomSummaryMaxDirectoryPages pages, notFoundErr is returned.
+func (cli *Client) roomSummaryFromDirectory(ctx context.Context, roomIDorAlias string, via []string, notFoundErr error) (*RespRoomSummary, error) {
+	var server string
+	if len(via) > 0 {
+		server = via[0]
+	}
+	var since string
+	for page := 0; page < roomSummaryMaxDirectoryPages; page++ {
+		rooms, err := cli.PublicRooms(ctx, 0, since, server)
+		if err != nil {
+			return nil, err
+		}
+		for _, room := range rooms.Chunk {
+			if room.matches(roomIDorAlias) {
+				return &RespRoomSummary{
+					RoomID:           room.RoomID,
+					CanonicalAlias:   room.CanonicalAlias,
+					Name:             room.Name,
+					Topic:            room.Topic,
+					AvatarURL:        room.AvatarURL,
+					NumJoinedMembers: room.NumJoinedMembers,
+					JoinRule:         JoinRulePublic,
+					WorldReadable:    room.WorldReadable,
+					GuestCanJoin:     room.GuestCanJoin,
+				}, nil
+			}
+		}
+		if rooms.NextBatch == "" || rooms.NextBatch == since {
+			break
+		}
+		since = rooms.NextBatch
+	}
+	return nil, notFoundErr
+}
+
+// isUnsupportedEndpoint returns true if err indicates that the homeserver does not implement the requested endpoint.
+func isUnsupportedEndpoint(err error) bool {
+	httpErr, ok := err.(*HTTPError)
+	if !ok {
+		return false
+	}
+	return httpErr.Code == http.StatusNotFound || httpErr.Code == http.StatusMethodNotAllowed ||
+		httpErr.MatrixError.ErrCode == ErrCodeUnrecognized
+}
+
 // JoinRoom joins the client to a room ID or alias. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-join-roomidoralias
 //
 // If serverName is specified, this will be added as a query param to instruct the homeserver to join via that server. If content is specified, it will
@@ -458,6 +1062,43 @@ func (cli *Client) JoinRoom(ctx context.Context, roomIDorAlias, serverName strin
 	return
 }
 
+// JoinRoomWithReq joins the client to a room ID or alias like JoinRoom, with a typed request body for the join
+// reason and third-party signed invites. req may be nil.
+func (cli *Client) JoinRoomWithReq(ctx context.Context, roomIDorAlias, serverName string, req *ReqJoinRoom) (resp *RespJoinRoom, err error) {
+	if req == nil {
+		req = &ReqJoinRoom{}
+	}
+	return cli.JoinRoom(ctx, roomIDorAlias, serverName, req)
+}
+
+// JoinRoomVia joins the client to a room ID or alias, asking the homeserver to try joining via each of the given
+// servers, e.g. the via servers of a matrix.to link. req may be nil.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-join-roomidoralias
+func (cli *Client) JoinRoomVia(ctx context.Context, roomIDorAlias string, via []string, req *ReqJoinRoom) (resp *RespJoinRoom, err error) {
+	if req == nil {
+		req = &ReqJoinRoom{}
+	}
+	u := cli.BuildURLWithValues([]string{"join", roomIDorAlias}, url.Values{"server_name": via})
+	err = cli.MakeRequest(ctx, "POST", u, req, &resp)
+	return
+}
+
+// ResolveAndJoin resolves a room alias and joins the room it points to, returning the room ID along with the join
+// response. The room is joined via the given servers, or via the servers returned when resolving the alias if there
+// are none. If the alias can't be resolved, roomID is empty. If it resolves but the join fails, e.g. with an error
+// matching ErrForbidden because the room is invite-only, roomID is returned along with the error.
+func (cli *Client) ResolveAndJoin(ctx context.Context, alias string, via []string) (roomID string, resp *RespJoinRoom, err error) {
+	resolved, err := cli.RoomAlias(ctx, alias)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(via) == 0 {
+		via = resolved.Servers
+	}
+	resp, err = cli.JoinRoomVia(ctx, resolved.RoomID, via, nil)
+	return resolved.RoomID, resp, err
+}
+
 // GetDisplayName returns the display name of the user from the specified MXID. See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-profile-userid-displayname
 func (cli *Client) GetDisplayName(ctx context.Context, mxid string) (resp *RespUserDisplayName, err error) {
 	urlPath := cli.BuildURL("profile", mxid, "displayname")
@@ -523,12 +1164,26 @@ func (cli *Client) GetOwnStatus(ctx context.Context) (resp *RespUserStatus, err
 	return cli.GetStatus(ctx, cli.UserID)
 }
 
-// SetStatus sets the user's status. See https://matrix.org/docs/spec/client_server/r0.6.0#put-matrix-client-r0-presence-userid-status
+// Presence states for SetStatus.
+const (
+	PresenceOnline      = "online"
+	PresenceOffline     = "offline"
+	PresenceUnavailable = "unavailable"
+)
+
+// SetStatus sets the user's status. presence must be PresenceOnline, PresenceOffline or PresenceUnavailable.
+// An empty status is omitted from the request.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#put-matrix-client-r0-presence-userid-status
 func (cli *Client) SetStatus(ctx context.Context, presence, status string) (err error) {
+	switch presence {
+	case PresenceOnline, PresenceOffline, PresenceUnavailable:
+	default:
+		return fmt.Errorf("invalid presence %q: must be %q, %q or %q", presence, PresenceOnline, PresenceOffline, PresenceUnavailable)
+	}
 	urlPath := cli.BuildURL("presence", cli.UserID, "status")
 	s := struct {
 		Presence  string `json:"presence"`
-		StatusMsg string `json:"status_msg"`
+		StatusMsg string `json:"status_msg,omitempty"`
 	}{presence, status}
 	err = cli.MakeRequest(ctx, "PUT", urlPath, &s, nil)
 	return
@@ -536,8 +1191,19 @@ func (cli *Client) SetStatus(ctx context.Context, presence, status string) (err
 
 // SendMessageEvent sends a message event into a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-send-eventtype-txnid
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
+//
+// A new transaction ID is generated for every call, so retrying after a network error may send the event twice.
+// Use SendMessageEventWithTxn to retry safely.
 func (cli *Client) SendMessageEvent(ctx context.Context, roomID string, eventType string, contentJSON interface{}) (resp *RespSendEvent, err error) {
-	txnID := txnID()
+	return cli.SendMessageEventWithTxn(ctx, roomID, eventType, txnID(), contentJSON)
+}
+
+// SendMessageEventWithTxn sends a message event into a room using the caller's transaction ID.
+// See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-send-eventtype-txnid
+//
+// The homeserver deduplicates requests which reuse a transaction ID with the same access token, returning the
+// event ID of the original event, so a request can be retried with the same txnID without sending it twice.
+func (cli *Client) SendMessageEventWithTxn(ctx context.Context, roomID, eventType, txnID string, contentJSON interface{}) (resp *RespSendEvent, err error) {
 	urlPath := cli.BuildURL("rooms", roomID, "send", eventType, txnID)
 	err = cli.MakeRequest(ctx, "PUT", urlPath, contentJSON, &resp)
 	return
@@ -551,6 +1217,17 @@ func (cli *Client) SendStateEvent(ctx context.Context, roomID, eventType, stateK
 	return
 }
 
+// SetState is like SendStateEvent, but content is encoded as JSON before anything is sent, so that content which
+// can't be encoded fails with a *ContentError rather than a failed request. An empty stateKey sets the state event
+// with the empty state key, as used by most room state such as m.room.name.
+func (cli *Client) SetState(ctx context.Context, roomID, eventType, stateKey string, content interface{}) (*RespSendEvent, error) {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return nil, &ContentError{EventType: eventType, Err: err}
+	}
+	return cli.SendStateEvent(ctx, roomID, eventType, stateKey, json.RawMessage(contentJSON))
+}
+
 // SendText sends an m.room.message event into the given room with a msgtype of m.text
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#m-text
 func (cli *Client) SendText(ctx context.Context, roomID, text string) (*RespSendEvent, error) {
@@ -558,6 +1235,14 @@ func (cli *Client) SendText(ctx context.Context, roomID, text string) (*RespSend
 		TextMessage{MsgType: "m.text", Body: text})
 }
 
+// SendTextWithMentions sends an m.room.message event into the given room with a msgtype of m.text which pings
+// exactly the given users, and the whole room if room is true. With no users and room false, no one is pinged.
+// See https://spec.matrix.org/v1.7/client-server-api/#user-and-room-mentions
+func (cli *Client) SendTextWithMentions(ctx context.Context, roomID, text string, userIDs []string, room bool) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(ctx, roomID, "m.room.message",
+		TextMessage{MsgType: "m.text", Body: text, Mentions: &Mentions{UserIDs: userIDs, Room: room}})
+}
+
 // SendFormattedText sends an m.room.message event into the given room with a msgtype of m.text, supports a subset of HTML for formatting.
 // See https://matrix.org/docs/spec/client_server/r0.6.0#m-text
 func (cli *Client) SendFormattedText(ctx context.Context, roomID, text, formattedText string) (*RespSendEvent, error) {
@@ -594,6 +1279,13 @@ func (cli *Client) SendNotice(ctx context.Context, roomID, text string) (*RespSe
 		TextMessage{MsgType: "m.notice", Body: text})
 }
 
+// SendFormattedNotice sends an m.room.message event into the given room with a msgtype of m.notice, supports a subset of HTML for formatting.
+// See https://matrix.org/docs/spec/client_server/r0.6.0#m-notice
+func (cli *Client) SendFormattedNotice(ctx context.Context, roomID, text, formattedText string) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(ctx, roomID, "m.room.message",
+		TextMessage{MsgType: "m.notice", Body: text, FormattedBody: formattedText, Format: "org.matrix.custom.html"})
+}
+
 // RedactEvent redacts the given event. See http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-redact-eventid-txnid
 func (cli *Client) RedactEvent(ctx context.Context, roomID, eventID string, req *ReqRedact) (resp *RespSendEvent, err error) {
 	txnID := txnID()
@@ -609,12 +1301,46 @@ func (cli *Client) MarkRead(ctx context.Context, roomID, eventID string) error {
 }
 
 // CreateRoom creates a new Matrix room. See https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
+//
+// If req.RoomAliasName is set and the homeserver does not return the full alias, resp.RoomAlias is filled in using
+// the server name of the client's user ID, which is the server the alias is created on.
 func (cli *Client) CreateRoom(ctx context.Context, req *ReqCreateRoom) (resp *RespCreateRoom, err error) {
 	urlPath := cli.BuildURL("createRoom")
 	err = cli.MakeRequest(ctx, "POST", urlPath, req, &resp)
+	if err == nil && resp.RoomAlias == "" && req.RoomAliasName != "" {
+		resp.RoomAlias = cli.localAlias(req.RoomAliasName)
+	}
 	return
 }
 
+// CreateRoomIfNotExists is like CreateRoom, but if req.RoomAliasName is set and the alias is already taken, which
+// the homeserver reports with M_ROOM_IN_USE, the alias is resolved and the room it points to is returned with
+// created=false instead of an error. This makes provisioning which may be re-run idempotent. Other errors are
+// returned as they are.
+func (cli *Client) CreateRoomIfNotExists(ctx context.Context, req *ReqCreateRoom) (resp *RespCreateRoom, created bool, err error) {
+	resp, err = cli.CreateRoom(ctx, req)
+	if err == nil {
+		return resp, true, nil
+	}
+	if req.RoomAliasName == "" || !IsMatrixError(err, ErrCodeRoomInUse) {
+		return nil, false, err
+	}
+	alias := cli.localAlias(req.RoomAliasName)
+	existing, err := cli.RoomAlias(ctx, alias)
+	if err != nil {
+		return nil, false, err
+	}
+	return &RespCreateRoom{RoomID: existing.RoomID, RoomAlias: alias}, false, nil
+}
+
+// localAlias returns the full alias for the localpart name on the homeserver of the client's user.
+func (cli *Client) localAlias(name string) string {
+	if parts := strings.SplitN(cli.UserID, ":", 2); len(parts) == 2 {
+		return "#" + name + ":" + parts[1]
+	}
+	return ""
+}
+
 // LeaveRoom leaves the given room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-leave
 func (cli *Client) LeaveRoom(ctx context.Context, roomID string) (resp *RespLeaveRoom, err error) {
 	u := cli.BuildURL("rooms", roomID, "leave")
@@ -636,6 +1362,22 @@ func (cli *Client) InviteUser(ctx context.Context, roomID string, req *ReqInvite
 	return
 }
 
+// InviteUsers invites each of the users to a room with the given reason, one at a time. The returned map contains an
+// entry for every user whose invite failed. If ctx is cancelled, no further invites are sent and ctx.Err() is
+// returned along with the failures so far; users not in the map may then not have been invited.
+func (cli *Client) InviteUsers(ctx context.Context, roomID string, userIDs []string, reason string) (map[string]error, error) {
+	failed := make(map[string]error)
+	for _, userID := range userIDs {
+		if err := ctx.Err(); err != nil {
+			return failed, err
+		}
+		if _, err := cli.InviteUser(ctx, roomID, &ReqInviteUser{UserID: userID, Reason: reason}); err != nil {
+			failed[userID] = err
+		}
+	}
+	return failed, nil
+}
+
 // InviteUserByThirdParty invites a third-party identifier to a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#invite-by-third-party-id-endpoint
 func (cli *Client) InviteUserByThirdParty(ctx context.Context, roomID string, req *ReqInvite3PID) (resp *RespInviteUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "invite")
@@ -644,19 +1386,67 @@ func (cli *Client) InviteUserByThirdParty(ctx context.Context, roomID string, re
 }
 
 // KickUser kicks a user from a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-kick
+// See Client.PrecheckPermissions and Client.DefaultModerationReason.
 func (cli *Client) KickUser(ctx context.Context, roomID string, req *ReqKickUser) (resp *RespKickUser, err error) {
+	if req == nil {
+		return nil, fmt.Errorf("kick request must not be nil")
+	}
+	if err = cli.precheckModeration(ctx, roomID, "kick", req.UserID); err != nil {
+		return
+	}
+	if req.Reason == "" && cli.DefaultModerationReason != "" {
+		req = &ReqKickUser{Reason: cli.DefaultModerationReason, UserID: req.UserID}
+	}
 	u := cli.BuildURL("rooms", roomID, "kick")
 	err = cli.MakeRequest(ctx, "POST", u, req, &resp)
 	return
 }
 
 // BanUser bans a user from a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-ban
+// See Client.PrecheckPermissions and Client.DefaultModerationReason.
 func (cli *Client) BanUser(ctx context.Context, roomID string, req *ReqBanUser) (resp *RespBanUser, err error) {
+	if req == nil {
+		return nil, fmt.Errorf("ban request must not be nil")
+	}
+	if err = cli.precheckModeration(ctx, roomID, "ban", req.UserID); err != nil {
+		return
+	}
+	if req.Reason == "" && cli.DefaultModerationReason != "" {
+		req = &ReqBanUser{Reason: cli.DefaultModerationReason, UserID: req.UserID}
+	}
 	u := cli.BuildURL("rooms", roomID, "ban")
 	err = cli.MakeRequest(ctx, "POST", u, req, &resp)
 	return
 }
 
+// precheckModeration returns a *PermissionError if PrecheckPermissions is set and the client's user isn't allowed
+// to kick or ban target in the room. action is "kick" or "ban".
+func (cli *Client) precheckModeration(ctx context.Context, roomID, action, target string) error {
+	if !cli.PrecheckPermissions {
+		return nil
+	}
+	pl, err := cli.PowerLevels(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	allowed, required := pl.CanKickUser(cli.UserID, target), pl.Kick
+	if action == "ban" {
+		allowed, required = pl.CanBanUser(cli.UserID, target), pl.Ban
+	}
+	if allowed {
+		return nil
+	}
+	return &PermissionError{
+		UserID:        cli.UserID,
+		RoomID:        roomID,
+		Action:        action,
+		Target:        target,
+		UserLevel:     pl.GetUserLevel(cli.UserID),
+		RequiredLevel: required,
+		TargetLevel:   pl.GetUserLevel(target),
+	}
+}
+
 // UnbanUser unbans a user from a room. See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-unban
 func (cli *Client) UnbanUser(ctx context.Context, roomID string, req *ReqUnbanUser) (resp *RespUnbanUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "unban")
@@ -672,6 +1462,55 @@ func (cli *Client) UserTyping(ctx context.Context, roomID string, typing bool, t
 	return
 }
 
+// typingTimeout is the timeout, in milliseconds, sent by StartTyping.
+const typingTimeout = 30000
+
+// typingStopTimeout bounds the typing=false request sent by the stop function returned by StartTyping.
+const typingStopTimeout = 10 * time.Second
+
+// StartTyping marks the user as typing in the given room until the returned stop function is called. The typing
+// notification is re-sent before it expires, at 80% of its timeout, so that it stays visible for however long the
+// caller takes. Calling stop sends typing=false and waits for the refresh goroutine to exit; it is safe to call more
+// than once. Cancelling ctx also stops the refreshes, but stop should still be called: typing=false is sent with its
+// own short timeout rather than with ctx, so it still clears the indicator after ctx is cancelled.
+// See https://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-typing-userid
+func (cli *Client) StartTyping(ctx context.Context, roomID string) (stop func(), err error) {
+	if _, err = cli.UserTyping(ctx, roomID, true, typingTimeout); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(typingTimeout * time.Millisecond * 8 / 10)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				// Errors are ignored: the next tick will try again, and the worst case is a flickering indicator.
+				_, _ = cli.UserTyping(ctx, roomID, true, typingTimeout)
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+			stopCtx, cancel := context.WithTimeout(context.Background(), typingStopTimeout)
+			defer cancel()
+			_, _ = cli.UserTyping(stopCtx, roomID, false, 0)
+		})
+	}
+	return stop, nil
+}
+
 // StateEvent gets a single state event in a room. It will attempt to JSON unmarshal into the given "outContent" struct with
 // the HTTP response body, or return an error.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-rooms-roomid-state-eventtype-statekey
@@ -681,6 +1520,41 @@ func (cli *Client) StateEvent(ctx context.Context, roomID, eventType, stateKey s
 	return
 }
 
+// StateEventFull gets a single state event in a room, including its sender, event ID and timestamp rather than just
+// its content. This uses the format=event query parameter supported by Synapse.
+// See https://spec.matrix.org/v1.7/client-server-api/#get_matrixclientv3roomsroomidstateeventtypestatekey
+func (cli *Client) StateEventFull(ctx context.Context, roomID, eventType, stateKey string) (resp *Event, err error) {
+	u := cli.BuildURLWithQuery([]string{"rooms", roomID, "state", eventType, stateKey}, map[string]string{
+		"format": "event",
+	})
+	err = cli.MakeRequest(ctx, "GET", u, nil, &resp)
+	return
+}
+
+// RoomState gets all the current state events of a room.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-rooms-roomid-state
+func (cli *Client) RoomState(ctx context.Context, roomID string) (resp []Event, err error) {
+	u := cli.BuildURL("rooms", roomID, "state")
+	err = cli.MakeRequest(ctx, "GET", u, nil, &resp)
+	return
+}
+
+// RoomStateByType gets the current state events of a room with the given type, e.g. every m.space.child event of a
+// space, in a single request. The full state is fetched and filtered client side, as the homeserver can't filter it.
+func (cli *Client) RoomStateByType(ctx context.Context, roomID, eventType string) ([]Event, error) {
+	state, err := cli.RoomState(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	for _, event := range state {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
 // UploadLink uploads an HTTP URL and then returns an MXC URI.
 func (cli *Client) UploadLink(ctx context.Context, link string) (*RespMediaUpload, error) {
 	res, err := cli.Client.Get(link)
@@ -696,13 +1570,14 @@ func (cli *Client) UploadLink(ctx context.Context, link string) (*RespMediaUploa
 // UploadToContentRepo uploads the given bytes to the content repository and returns an MXC URI.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-media-r0-upload
 func (cli *Client) UploadToContentRepo(ctx context.Context, content io.Reader, contentType string, contentLength int64) (*RespMediaUpload, error) {
-	req, err := http.NewRequest(http.MethodPost, cli.BuildBaseURL("_matrix/media/r0/upload"), content)
+	req, err := http.NewRequest(http.MethodPost, cli.BuildMediaURL("upload"), content)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	cli.applyDefaultHeaders(req)
+	req.Header.Set("Content-Type", contentType)
 
 	req.ContentLength = contentLength
 
@@ -727,6 +1602,165 @@ func (cli *Client) UploadToContentRepo(ctx context.Context, content io.Reader, c
 	return &m, nil
 }
 
+// UploadToContentRepoWithHash is like UploadToContentRepo, but also returns the hex encoded SHA-256 digest of the
+// bytes which were read from content and sent, along with how many there were. Comparing the count against the
+// expected length detects truncated uploads, and the digest can be used to verify later downloads.
+func (cli *Client) UploadToContentRepoWithHash(ctx context.Context, content io.Reader, contentType string, contentLength int64) (resp *RespMediaUpload, sha256Hex string, n int64, err error) {
+	hash := sha256.New()
+	counter := &countingWriter{}
+	resp, err = cli.UploadToContentRepo(ctx, io.TeeReader(content, io.MultiWriter(hash, counter)), contentType, contentLength)
+	if err != nil {
+		return nil, "", counter.n, err
+	}
+	return resp, hex.EncodeToString(hash.Sum(nil)), counter.n, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// UploadBytes uploads the given bytes to the content repository and returns an MXC URI. If contentType is empty, it
+// is detected from the first 512 bytes of data using http.DetectContentType.
+// See http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-media-r0-upload
+func (cli *Client) UploadBytes(ctx context.Context, data []byte, contentType string) (*RespMediaUpload, error) {
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return cli.UploadToContentRepo(ctx, bytes.NewReader(data), contentType, int64(len(data)))
+}
+
+// MXCToHTTP converts an mxc://server/id URI to the HTTP URL to download the content from the client's homeserver.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-media-r0-download-servername-mediaid
+func (cli *Client) MXCToHTTP(mxcURI string) (string, error) {
+	serverName, mediaID, err := parseMXC(mxcURI)
+	if err != nil {
+		return "", err
+	}
+	return cli.BuildMediaURL("download", serverName, mediaID), nil
+}
+
+// MXCToThumbnailHTTP converts an mxc://server/id URI to the HTTP URL of a thumbnail of the content on the client's
+// homeserver. method must be "crop" or "scale".
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-media-r0-thumbnail-servername-mediaid
+func (cli *Client) MXCToThumbnailHTTP(mxcURI string, width, height int, method string) (string, error) {
+	serverName, mediaID, err := parseMXC(mxcURI)
+	if err != nil {
+		return "", err
+	}
+	if method != "crop" && method != "scale" {
+		return "", fmt.Errorf("invalid thumbnail method %q: must be \"crop\" or \"scale\"", method)
+	}
+	if width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid thumbnail size %dx%d", width, height)
+	}
+	return withQuery(cli.BuildMediaURL("thumbnail", serverName, mediaID), url.Values{
+		"width":  {strconv.Itoa(width)},
+		"height": {strconv.Itoa(height)},
+		"method": {method},
+	}), nil
+}
+
+// parseMXC splits an mxc://server/id URI into its server name and media ID.
+func parseMXC(mxcURI string) (serverName, mediaID string, err error) {
+	if !strings.HasPrefix(mxcURI, "mxc://") {
+		return "", "", fmt.Errorf("not an mxc uri: %q", mxcURI)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(mxcURI, "mxc://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return "", "", fmt.Errorf("invalid mxc uri: %q", mxcURI)
+	}
+	return parts[0], parts[1], nil
+}
+
+// DownloadEventMedia downloads the media referenced by a media event such as m.image or m.file and returns a reader
+// for its bytes along with its content type. The MXC URI is taken from the "url" key of the event content, or from
+// "file.url" for encrypted attachments (the returned bytes are then still encrypted). The caller must close the
+// returned reader.
+//
+// If the homeserver responds with a missing or generic Content-Type, the "info.mimetype" of the event is used instead,
+// falling back to sniffing the first bytes of the content.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-media-r0-download-servername-mediaid
+func (cli *Client) DownloadEventMedia(ctx context.Context, ev *Event) (io.ReadCloser, string, error) {
+	mxc, mimetype := eventMedia(ev)
+	if mxc == "" {
+		return nil, "", fmt.Errorf("event %s has no media url", ev.ID)
+	}
+	downloadURL, err := cli.MXCToHTTP(mxc)
+	if err != nil {
+		return nil, "", fmt.Errorf("event %s has an invalid media url: %w", ev.ID, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if cli.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	}
+	if cli.DisableMediaCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	cli.applyDefaultHeaders(req)
+
+	res, err := cli.Client.Do(req)
+	if err != nil {
+		if res != nil {
+			res.Body.Close()
+		}
+		return nil, "", err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, "", respToHttpErr(res, req, http.MethodGet)
+	}
+	if enc := res.Header.Get("Content-Encoding"); cli.DisableMediaCompression && enc != "" && enc != "identity" {
+		res.Body.Close()
+		return nil, "", fmt.Errorf("media download for event %s: unexpected Content-Encoding %q", ev.ID, enc)
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if isGenericContentType(contentType) && mimetype != "" {
+		contentType = mimetype
+	}
+	if !isGenericContentType(contentType) {
+		return res.Body, contentType, nil
+	}
+
+	// Neither the homeserver nor the event told us what this is, so sniff it.
+	br := bufio.NewReader(res.Body)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		res.Body.Close()
+		return nil, "", err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, res.Body}, http.DetectContentType(head), nil
+}
+
+// eventMedia returns the MXC URI and the info.mimetype of a media event, if present.
+func eventMedia(ev *Event) (mxc, mimetype string) {
+	if u, ok := ev.Content["url"].(string); ok {
+		mxc = u
+	} else if file, ok := ev.Content["file"].(map[string]interface{}); ok {
+		mxc, _ = file["url"].(string)
+	}
+	if info, ok := ev.Content["info"].(map[string]interface{}); ok {
+		mimetype, _ = info["mimetype"].(string)
+	}
+	return
+}
+
+func isGenericContentType(contentType string) bool {
+	return contentType == "" || strings.HasPrefix(contentType, "application/octet-stream")
+}
+
 // JoinedMembers returns a map of joined room members. See TODO-SPEC. https://github.com/matrix-org/synapse/pull/1680
 //
 // In general, usage of this API is discouraged in favour of /sync, as calling this API can race with incoming membership changes.
@@ -747,13 +1781,88 @@ func (cli *Client) JoinedRooms(ctx context.Context) (resp *RespJoinedRooms, err
 	return
 }
 
+// JoinedRoomsSummary fetches the rooms the user has joined, and then the name and avatar of each room using up to
+// concurrency parallel requests (1 if concurrency is less than 1). Failing to fetch the state of a room does not fail
+// the call; instead the error is stored in the room's JoinedRoomSummary.Err. A room without a name or avatar is not
+// an error. If ctx is cancelled, ctx.Err() is returned.
+func (cli *Client) JoinedRoomsSummary(ctx context.Context, concurrency int) (map[string]JoinedRoomSummary, error) {
+	joined, err := cli.JoinedRooms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		summaries = make(map[string]JoinedRoomSummary, len(joined.JoinedRooms))
+		roomIDs   = make(chan string)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for roomID := range roomIDs {
+				summary := cli.joinedRoomSummary(ctx, roomID)
+				mu.Lock()
+				summaries[roomID] = summary
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, roomID := range joined.JoinedRooms {
+		select {
+		case roomIDs <- roomID:
+		case <-ctx.Done():
+		}
+	}
+	close(roomIDs)
+	wg.Wait()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+func (cli *Client) joinedRoomSummary(ctx context.Context, roomID string) JoinedRoomSummary {
+	summary := JoinedRoomSummary{RoomID: roomID}
+	var name NameEventContent
+	if err := cli.StateEvent(ctx, roomID, "m.room.name", "", &name); err != nil && !IsMatrixError(err, ErrCodeNotFound) {
+		summary.Err = err
+		return summary
+	}
+	summary.Name = name.Name
+	var avatar RoomAvatarEventContent
+	if err := cli.StateEvent(ctx, roomID, "m.room.avatar", "", &avatar); err != nil && !IsMatrixError(err, ErrCodeNotFound) {
+		summary.Err = err
+		return summary
+	}
+	summary.AvatarURL = avatar.URL
+	return summary
+}
+
+// Directions for Messages.
+const (
+	DirBackward rune = 'b'
+	DirForward  rune = 'f'
+)
+
 // Messages returns a list of message and state events for a room. It uses
-// pagination query parameters to paginate history in the room.
+// pagination query parameters to paginate history in the room. dir must be
+// DirBackward or DirForward. If from is empty, it is omitted, which homeservers
+// supporting v1.3 of the spec treat as the start or end of the room.
 // See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-rooms-roomid-messages
 func (cli *Client) Messages(ctx context.Context, roomID, from, to string, dir rune, limit int) (resp *RespMessages, err error) {
+	if dir != DirBackward && dir != DirForward {
+		return nil, fmt.Errorf("invalid messages direction %q: must be 'b' or 'f'", dir)
+	}
 	query := map[string]string{
-		"from": from,
-		"dir":  string(dir),
+		"dir": string(dir),
+	}
+	if from != "" {
+		query["from"] = from
 	}
 	if to != "" {
 		query["to"] = to
@@ -767,6 +1876,69 @@ func (cli *Client) Messages(ctx context.Context, roomID, from, to string, dir ru
 	return
 }
 
+// MessagesIterator pages through the history of a room. See Client.MessagesIterator.
+type MessagesIterator struct {
+	cli    *Client
+	ctx    context.Context
+	roomID string
+	from   string
+	dir    rune
+	limit  int
+	done   bool
+}
+
+// MessagesIterator returns an iterator which calls Messages repeatedly, following the end token of each page,
+// until the homeserver returns an empty chunk or no end token.
+//
+//	it := cli.MessagesIterator(ctx, roomID, prevBatch, gomatrix.DirBackward, 100)
+//	for {
+//		events, ok, err := it.Next()
+//		if err != nil {
+//			return err
+//		}
+//		if !ok {
+//			break
+//		}
+//		// handle events
+//	}
+func (cli *Client) MessagesIterator(ctx context.Context, roomID, from string, dir rune, limit int) *MessagesIterator {
+	return &MessagesIterator{
+		cli:    cli,
+		ctx:    ctx,
+		roomID: roomID,
+		from:   from,
+		dir:    dir,
+		limit:  limit,
+	}
+}
+
+// Next returns the next page of events. ok is false once there are no more events, or if an error occurred. Once
+// Next has returned ok=false it keeps doing so. Errors are not retried: if the context is cancelled, Next returns
+// the context's error.
+func (it *MessagesIterator) Next() (events []Event, ok bool, err error) {
+	if it.done {
+		return nil, false, nil
+	}
+	if err = it.ctx.Err(); err != nil {
+		it.done = true
+		return nil, false, err
+	}
+	resp, err := it.cli.Messages(it.ctx, it.roomID, it.from, "", it.dir, it.limit)
+	if err != nil {
+		it.done = true
+		return nil, false, err
+	}
+	if len(resp.Chunk) == 0 {
+		it.done = true
+		return nil, false, nil
+	}
+	if resp.End == "" || resp.End == it.from {
+		it.done = true
+	}
+	it.from = resp.End
+	return resp.Chunk, true, nil
+}
+
 // TurnServer returns turn server details and credentials for the client to use when initiating calls.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-voip-turnserver
 func (cli *Client) TurnServer(ctx context.Context) (resp *RespTurnServer, err error) {
@@ -811,6 +1983,14 @@ func (cli *Client) PasswordEmailRequestToken(ctx context.Context, req ReqEmailRe
 	return
 }
 
+// SubmitToken submits a 3PID validation token, such as the code sent by email or SMS after a requestToken call, to
+// submitURL. submitURL must be the submit_url returned by the requestToken call: homeservers don't serve the identity
+// service's validation endpoints themselves. See https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-msisdn-requesttoken
+func (cli *Client) SubmitToken(ctx context.Context, submitURL string, req ReqSubmitToken) (resp *RespSubmitToken, err error) {
+	err = cli.MakeRequest(ctx, "POST", submitURL, req, &resp)
+	return
+}
+
 func (cli *Client) AccountPassword(ctx context.Context, req ReqAccountPassword) (err error) {
 	u := cli.BuildURL("account", "password")
 	err = cli.MakeRequest(ctx, "POST", u, req, nil)
@@ -826,6 +2006,19 @@ func (cli *Client) GetAccountData(ctx context.Context, req ReqGetAccountData) (r
 	return
 }
 
+// GetAccountDataTyped gets the account_data of the given type for the client and decodes it into out, which should
+// be a pointer to a struct. If the account data has never been set, out is left untouched and
+// ErrAccountDataNotFound is returned.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-user-userid-account-data-type
+func (cli *Client) GetAccountDataTyped(ctx context.Context, eventType string, out interface{}) error {
+	u := cli.BuildURL("user", cli.UserID, "account_data", eventType)
+	err := cli.MakeRequest(ctx, "GET", u, nil, out)
+	if IsMatrixError(err, ErrCodeNotFound) {
+		return ErrAccountDataNotFound
+	}
+	return err
+}
+
 // PutAccountData sets some account_data for the client.
 // See https://matrix.org/docs/spec/client_server/r0.6.1#put-matrix-client-r0-user-userid-account-data-type
 func (cli *Client) PutAccountData(ctx context.Context, req ReqPutAccountData) (err error) {
@@ -834,6 +2027,65 @@ func (cli *Client) PutAccountData(ctx context.Context, req ReqPutAccountData) (e
 	return
 }
 
+// GetIgnoredUsers returns the user IDs in the m.ignored_user_list account data. If the account data has never been
+// set, an empty list is returned.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-ignored-user-list
+func (cli *Client) GetIgnoredUsers(ctx context.Context) ([]string, error) {
+	list, err := cli.getIgnoredUserList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]string, 0, len(list.IgnoredUsers))
+	for userID := range list.IgnoredUsers {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs, nil
+}
+
+// IgnoreUser adds the user ID to the m.ignored_user_list account data. It is a no-op if the user is already ignored.
+func (cli *Client) IgnoreUser(ctx context.Context, userID string) error {
+	list, err := cli.getIgnoredUserList(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := list.IgnoredUsers[userID]; ok {
+		return nil
+	}
+	list.IgnoredUsers[userID] = struct{}{}
+	return cli.putIgnoredUserList(ctx, list)
+}
+
+// UnignoreUser removes the user ID from the m.ignored_user_list account data. It is a no-op if the user is not ignored.
+func (cli *Client) UnignoreUser(ctx context.Context, userID string) error {
+	list, err := cli.getIgnoredUserList(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := list.IgnoredUsers[userID]; !ok {
+		return nil
+	}
+	delete(list.IgnoredUsers, userID)
+	return cli.putIgnoredUserList(ctx, list)
+}
+
+func (cli *Client) getIgnoredUserList(ctx context.Context) (*IgnoredUserListEventContent, error) {
+	var list IgnoredUserListEventContent
+	u := cli.BuildURL("user", cli.UserID, "account_data", "m.ignored_user_list")
+	if err := cli.MakeRequest(ctx, "GET", u, nil, &list); err != nil && !IsMatrixError(err, ErrCodeNotFound) {
+		return nil, err
+	}
+	if list.IgnoredUsers == nil {
+		list.IgnoredUsers = make(map[string]struct{})
+	}
+	return &list, nil
+}
+
+func (cli *Client) putIgnoredUserList(ctx context.Context, list *IgnoredUserListEventContent) error {
+	u := cli.BuildURL("user", cli.UserID, "account_data", "m.ignored_user_list")
+	return cli.MakeRequest(ctx, "PUT", u, list, nil)
+}
+
 // GetDevices gets information about all devices for the current user.
 // See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-devices
 func (cli *Client) GetDevices(ctx context.Context) (resp RespGetDevices, err error) {
@@ -843,6 +2095,32 @@ func (cli *Client) GetDevices(ctx context.Context) (resp RespGetDevices, err err
 	return
 }
 
+// GetDevice gets information about a single device of the current user. If the device doesn't exist, the returned
+// error matches ErrNotFound.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-devices-deviceid
+func (cli *Client) GetDevice(ctx context.Context, deviceID string) (resp *Device, err error) {
+	u := cli.BuildURL("devices", deviceID)
+	err = cli.MakeRequest(ctx, "GET", u, nil, &resp)
+	return
+}
+
+// UploadKeys publishes end-to-end encryption keys for the current device, including fallback keys. The keys are
+// opaque to this library. See https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3keysupload
+func (cli *Client) UploadKeys(ctx context.Context, req *ReqUploadKeys) (resp *RespUploadKeys, err error) {
+	u := cli.BuildURL("keys", "upload")
+	err = cli.MakeRequest(ctx, "POST", u, req, &resp)
+	return
+}
+
+// UploadSignatures publishes cross-signing signatures of keys. Signatures which were rejected are listed in the
+// Failures of the response rather than returned as an error.
+// See https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3keyssignaturesupload
+func (cli *Client) UploadSignatures(ctx context.Context, req ReqUploadSignatures) (resp *RespUploadSignatures, err error) {
+	u := cli.BuildURL("keys", "signatures", "upload")
+	err = cli.MakeRequest(ctx, "POST", u, req, &resp)
+	return
+}
+
 // GetThreePID gets a list of the third party identifiers that the homeserver has associated with the user's account.
 // See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-account-3pid
 func (cli *Client) GetThreePID(ctx context.Context) (resp RespGetThreePID, err error) {
@@ -857,6 +2135,41 @@ func (cli *Client) PostThreePID(ctx context.Context, req ReqPostThreePID) (err e
 	return
 }
 
+// Add3PID adds a third party identifier, which the homeserver has validated with the session req.Sid, to the user's
+// account. This only associates it with the homeserver; see Bind3PID to also bind it on an identity server. The
+// endpoint is protected by user-interactive authentication: if req.Auth is missing or incomplete, uiaResp is
+// returned with err nil, and the request should be retried with req.Auth set.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-add
+func (cli *Client) Add3PID(ctx context.Context, req *ReqAdd3PID) (uiaResp *RespUserInteractive, err error) {
+	u := cli.BuildURL("account", "3pid", "add")
+	return cli.makeUIARequest(ctx, "POST", u, req, nil)
+}
+
+// Bind3PID binds a third party identifier, which the identity server req.IDServer has validated with the session
+// req.Sid, to the user's Matrix ID on that identity server, so that others can find the user by it.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-bind
+func (cli *Client) Bind3PID(ctx context.Context, req *ReqBind3PID) error {
+	u := cli.BuildURL("account", "3pid", "bind")
+	return cli.MakeRequest(ctx, "POST", u, req, nil)
+}
+
+// DeleteThreePID removes a third party identifier from the user's account. medium must be "email" or "msisdn". If
+// idServer is set, the 3PID is also unbound from that identity server rather than the one it was bound with.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-delete
+func (cli *Client) DeleteThreePID(ctx context.Context, medium, address, idServer string) (resp *RespDeleteThreePID, err error) {
+	if medium != "email" && medium != "msisdn" {
+		return nil, fmt.Errorf("invalid 3pid medium %q: must be email or msisdn", medium)
+	}
+	u := cli.BuildURL("account", "3pid", "delete")
+	req := ReqDeleteThreePID{
+		IDServer: idServer,
+		Medium:   medium,
+		Address:  address,
+	}
+	err = cli.MakeRequest(ctx, http.MethodPost, u, req, &resp)
+	return
+}
+
 // Available checks to see if a username is available, and valid, for the server.
 // See https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-register-available
 func (cli *Client) Available(ctx context.Context, username string) (err error) {
@@ -903,21 +2216,230 @@ func (cli *Client) Members(ctx context.Context, roomId string) (resp RespMembers
 // SendPowerLevels sends m.room.power_levels event.
 // See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-power-levels
 func (cli *Client) SendPowerLevels(ctx context.Context, roomID string, pl PowerLevels) (*RespSendEvent, error) {
-	return cli.SendStateEvent(ctx, roomID, "m.room.power_levels", "", pl)
+	return cli.SetState(ctx, roomID, "m.room.power_levels", "", pl)
+}
+
+// SetJoinRule sends an m.room.join_rules event. allow is only sent for the restricted and knock_restricted join
+// rules, which require at least one allow condition.
+// See https://spec.matrix.org/v1.3/client-server-api/#mroomjoin_rules
+func (cli *Client) SetJoinRule(ctx context.Context, roomID, rule string, allow []AllowCondition) (*RespSendEvent, error) {
+	content := JoinRulesEventContent{JoinRule: rule}
+	switch rule {
+	case JoinRulePublic, JoinRuleInvite, JoinRuleKnock:
+	case JoinRuleRestricted, JoinRuleKnockRestricted:
+		if len(allow) == 0 {
+			return nil, fmt.Errorf("join rule %s requires at least one allow condition", rule)
+		}
+		content.Allow = allow
+	default:
+		return nil, fmt.Errorf("unknown join rule: %s", rule)
+	}
+	return cli.SetState(ctx, roomID, "m.room.join_rules", "", content)
+}
+
+// AddSpaceChild adds childRoomID to the space spaceID by sending an m.space.child event. via must list at least one
+// server through which the child can be joined, otherwise the relationship is ignored by homeservers.
+// See https://spec.matrix.org/v1.3/client-server-api/#mspacechild
+func (cli *Client) AddSpaceChild(ctx context.Context, spaceID, childRoomID string, via []string, order string, suggested bool) (*RespSendEvent, error) {
+	if len(via) == 0 {
+		return nil, fmt.Errorf("m.space.child for %s requires at least one via server", childRoomID)
+	}
+	content := SpaceChildEventContent{
+		Via:       via,
+		Order:     order,
+		Suggested: suggested,
+	}
+	return cli.SetState(ctx, spaceID, "m.space.child", childRoomID, content)
+}
+
+// AddSpaceParent marks parentSpaceID as a parent of roomID by sending an m.space.parent event. As with
+// AddSpaceChild, via must list at least one server.
+// See https://spec.matrix.org/v1.3/client-server-api/#mspaceparent
+func (cli *Client) AddSpaceParent(ctx context.Context, roomID, parentSpaceID string, via []string, canonical bool) (*RespSendEvent, error) {
+	if len(via) == 0 {
+		return nil, fmt.Errorf("m.space.parent for %s requires at least one via server", parentSpaceID)
+	}
+	content := SpaceParentEventContent{
+		Via:       via,
+		Canonical: canonical,
+	}
+	return cli.SetState(ctx, roomID, "m.space.parent", parentSpaceID, content)
+}
+
+// RoomVersion returns the version of a room from its m.room.create event. Rooms created before room versions
+// existed have no room_version, in which case "1" is returned.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-create
+func (cli *Client) RoomVersion(ctx context.Context, roomID string) (string, error) {
+	var content CreateEventContent
+	if err := cli.StateEvent(ctx, roomID, "m.room.create", "", &content); err != nil {
+		return "", err
+	}
+	if content.RoomVersion == "" {
+		return "1", nil
+	}
+	return content.RoomVersion, nil
+}
+
+// IsEncrypted returns true if the room has an m.room.encryption state event, i.e. messages sent to it should be
+// encrypted.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-encryption
+func (cli *Client) IsEncrypted(ctx context.Context, roomID string) (bool, error) {
+	var content EncryptionEventContent
+	err := cli.StateEvent(ctx, roomID, "m.room.encryption", "", &content)
+	if IsMatrixError(err, ErrCodeNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return content.Algorithm != "", nil
+}
+
+// EnableEncryption enables Megolm encryption in a room by sending an m.room.encryption event. rotationMsgs and
+// rotationMs set how often the session should be rotated; 0 leaves the default. Encryption cannot be disabled again.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-encryption
+func (cli *Client) EnableEncryption(ctx context.Context, roomID string, rotationMsgs, rotationMs int) (*RespSendEvent, error) {
+	content := EncryptionEventContent{
+		Algorithm:          AlgorithmMegolmV1,
+		RotationPeriodMs:   int64(rotationMs),
+		RotationPeriodMsgs: rotationMsgs,
+	}
+	return cli.SetState(ctx, roomID, "m.room.encryption", "", content)
+}
+
+// SetGuestAccess allows or forbids guest users from joining a room by sending an m.room.guest_access event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-guest-access
+func (cli *Client) SetGuestAccess(ctx context.Context, roomID string, allowed bool) (*RespSendEvent, error) {
+	content := GuestAccessEventContent{GuestAccess: GuestAccessForbidden}
+	if allowed {
+		content.GuestAccess = GuestAccessCanJoin
+	}
+	return cli.SetState(ctx, roomID, "m.room.guest_access", "", content)
+}
+
+// GuestAccess returns true if guest users may join a room. Guests are forbidden if the room has no
+// m.room.guest_access event.
+func (cli *Client) GuestAccess(ctx context.Context, roomID string) (bool, error) {
+	var content GuestAccessEventContent
+	err := cli.StateEvent(ctx, roomID, "m.room.guest_access", "", &content)
+	if IsMatrixError(err, ErrCodeNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return content.GuestAccess == GuestAccessCanJoin, nil
+}
+
+// SetCanonicalAlias sets the main and alternative published addresses of a room by sending an
+// m.room.canonical_alias event. An empty alias removes the main address.
+//
+// The homeserver rejects the event unless every alias already exists in the room directory, i.e. was created with
+// PUT /directory/room/{roomAlias}, and points at this room, so the aliases must be created first.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-canonical-alias
+func (cli *Client) SetCanonicalAlias(ctx context.Context, roomID, alias string, altAliases []string) (*RespSendEvent, error) {
+	content := CanonicalAliasEventContent{Alias: alias, AltAliases: altAliases}
+	return cli.SetState(ctx, roomID, "m.room.canonical_alias", "", content)
+}
+
+// CanonicalAlias returns the content of the m.room.canonical_alias event of a room. If the room has no such event,
+// an empty CanonicalAliasEventContent is returned.
+func (cli *Client) CanonicalAlias(ctx context.Context, roomID string) (*CanonicalAliasEventContent, error) {
+	var content CanonicalAliasEventContent
+	err := cli.StateEvent(ctx, roomID, "m.room.canonical_alias", "", &content)
+	if err != nil && !IsMatrixError(err, ErrCodeNotFound) {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// PinnedEvents returns the IDs of the events pinned in a room from its m.room.pinned_events event. If the room
+// has no such event, an empty list is returned.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-pinned-events
+func (cli *Client) PinnedEvents(ctx context.Context, roomID string) ([]string, error) {
+	var content PinnedEventsEventContent
+	err := cli.StateEvent(ctx, roomID, "m.room.pinned_events", "", &content)
+	if err != nil && !IsMatrixError(err, ErrCodeNotFound) {
+		return nil, err
+	}
+	if content.Pinned == nil {
+		return []string{}, nil
+	}
+	return content.Pinned, nil
 }
 
+// SetPinnedEvents replaces the list of events pinned in a room by sending an m.room.pinned_events event.
+func (cli *Client) SetPinnedEvents(ctx context.Context, roomID string, eventIDs []string) (*RespSendEvent, error) {
+	if eventIDs == nil {
+		eventIDs = []string{}
+	}
+	return cli.SetState(ctx, roomID, "m.room.pinned_events", "", PinnedEventsEventContent{Pinned: eventIDs})
+}
+
+// SetRoomAvatar sets the avatar of a room by sending an m.room.avatar event. info may be nil.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-avatar
+func (cli *Client) SetRoomAvatar(ctx context.Context, roomID, mxcURL string, info *ImageInfo) (*RespSendEvent, error) {
+	if _, _, err := parseMXC(mxcURL); err != nil {
+		return nil, err
+	}
+	return cli.SetState(ctx, roomID, "m.room.avatar", "", RoomAvatarEventContent{URL: mxcURL, Info: info})
+}
+
+// SetUserPowerLevel sets the power level of a single user in a room, leaving the rest of the m.room.power_levels
+// event untouched. The current event is fetched and decoded as raw JSON rather than into PowerLevels, so keys which
+// are absent or unknown to this library are sent back unchanged instead of being replaced with zero values.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-power-levels
+func (cli *Client) SetUserPowerLevel(ctx context.Context, roomID, userID string, level int) (*RespSendEvent, error) {
+	content := make(map[string]interface{})
+	if err := cli.StateEvent(ctx, roomID, "m.room.power_levels", "", &content); err != nil {
+		return nil, err
+	}
+	users, ok := content["users"].(map[string]interface{})
+	if !ok || users == nil {
+		users = make(map[string]interface{})
+	}
+	users[userID] = level
+	content["users"] = users
+	return cli.SetState(ctx, roomID, "m.room.power_levels", "", content)
+}
+
+// Hierarchy returns a page of the space hierarchy rooted at req.RoomId. To walk a large space, call it again with
+// req.From set to resp.NextBatch until NextBatch is empty.
+// See https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidhierarchy
 func (cli *Client) Hierarchy(ctx context.Context, req ReqHierarchy) (resp RespHierarchy, err error) {
-	u := cli.BuildURLWithQuery([]string{"rooms", req.RoomId, "hierarchy"}, map[string]string{
+	query := map[string]string{
 		"suggested_only": strconv.FormatBool(req.SuggestedOnly),
 		"limit":          strconv.Itoa(req.Limit),
-	})
+	}
+	if req.From != "" {
+		query["from"] = req.From
+	}
+	if req.MaxDepth > 0 {
+		query["max_depth"] = strconv.Itoa(req.MaxDepth)
+	}
+	u := cli.BuildURLWithQuery([]string{"rooms", req.RoomId, "hierarchy"}, query)
 	err = cli.MakeRequest(ctx, "GET", u, nil, &resp)
 	return
 }
 
-func (cli *Client) Deactivate(ctx context.Context) (err error) {
+// Deactivate deactivates the user's account. See https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-deactivate
+//
+// The homeserver almost always requires the user to re-authenticate first. If it does, uiaResp is returned and the
+// call should be repeated with auth set to the completed stage, e.g. for m.login.password:
+//
+//	auth := map[string]interface{}{
+//		"type":       "m.login.password",
+//		"identifier": gomatrix.NewUserIdentifier(cli.UserID),
+//		"password":   password,
+//		"session":    uiaResp.Session,
+//	}
+//
+// If idServer is set, 3PIDs are unbound from that identity server rather than the one they were bound with.
+func (cli *Client) Deactivate(ctx context.Context, auth interface{}, idServer string) (resp *RespDeactivate, uiaResp *RespUserInteractive, err error) {
 	u := cli.BuildURL("account", "deactivate")
-	err = cli.MakeRequest(ctx, "POST", u, struct{}{}, nil)
+	req := ReqDeactivate{
+		Auth:     auth,
+		IDServer: idServer,
+	}
+	uiaResp, err = cli.makeUIARequest(ctx, "POST", u, req, &resp)
 	return
 }
 
@@ -931,6 +2453,44 @@ func txnID() string {
 	return "go" + strconv.FormatInt(time.Now().UnixNano(), 10)
 }
 
+// sleepContext waits for d, returning early with ctx.Err() if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryRateLimited calls fn until it returns an error other than M_LIMIT_EXCEEDED, or has been retried maxRetries
+// times. Before each retry it waits for the delay requested by the homeserver or, if it didn't ask for one, the
+// duration returned by backoff. If ctx is done while waiting, ctx.Err() is returned.
+func retryRateLimited(ctx context.Context, maxRetries int, backoff func() time.Duration, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		var httpErr *HTTPError
+		if err == nil || attempt >= maxRetries || !errors.As(err, &httpErr) || !httpErr.Is(ErrLimitExceeded) {
+			return err
+		}
+		wait := time.Duration(httpErr.MatrixError.RetryAfterMs) * time.Millisecond
+		if wait <= 0 {
+			wait = backoff()
+		}
+		if err = sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
 // NewClient creates a new Matrix Client ready for syncing
 func NewClient(homeserverURL, userID, accessToken string) (*Client, error) {
 	hsURL, err := url.Parse(homeserverURL)
@@ -946,15 +2506,39 @@ func NewClient(homeserverURL, userID, accessToken string) (*Client, error) {
 		HomeserverURL: hsURL,
 		UserID:        userID,
 		Prefix:        "/_matrix/client/r0",
+		MediaPrefix:   "/_matrix/media/r0",
 		Syncer:        NewDefaultSyncer(userID, store),
 		Store:         store,
 	}
-	// By default, use the default HTTP client.
-	cli.Client = http.DefaultClient
+	// Use a dedicated HTTP client rather than http.DefaultClient, so that the connection pool can be tuned per
+	// client and isn't shared with the rest of the process.
+	cli.Client = &http.Client{Transport: NewTransport()}
 
 	return &cli, nil
 }
 
+// NewTransport returns the http.Transport used by NewClient. It is a copy of http.DefaultTransport which keeps more
+// idle connections open per host, as a client usually talks to a single homeserver. It can be tuned further and
+// passed to SetTransport.
+func NewTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 10
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	return transport
+}
+
+// SetTransport sets the transport used to make HTTP requests, e.g. a transport from NewTransport with different
+// connection pool settings. If Client is nil or http.DefaultClient, it is replaced with a new http.Client so that the
+// shared default client is never modified.
+func (cli *Client) SetTransport(transport http.RoundTripper) {
+	if cli.Client == nil || cli.Client == http.DefaultClient {
+		cli.Client = &http.Client{}
+	}
+	cli.Client.Transport = transport
+}
+
 func (cli *Client) PutPushRule(ctx context.Context, scope string, kind string, ruleID string, req *ReqPutPushRule) error {
 	query := make(map[string]string)
 	if len(req.After) > 0 {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 )
 
 var ctx = context.Background()
@@ -61,6 +62,15 @@ func ExampleClient_BuildURLWithQuery() {
 	// Output: https://matrix.org/_matrix/client/r0/sync?filter_id=5
 }
 
+func ExampleClient_BuildURLWithValues() {
+	cli, _ := NewClient("https://matrix.org", "@example:matrix.org", "abcdef123456")
+	out := cli.BuildURLWithValues([]string{"join", "#matrix:matrix.org"}, url.Values{
+		"server_name": {"matrix.org", "example.org"},
+	})
+	fmt.Println(out)
+	// Output: https://matrix.org/_matrix/client/r0/join/%23matrix:matrix.org?server_name=matrix.org&server_name=example.org
+}
+
 func ExampleClient_BuildURL() {
 	userID := "@example:matrix.org"
 	cli, _ := NewClient("https://matrix.org", userID, "abcdef123456")
@@ -120,3 +130,10 @@ func ExampleClient_Login() {
 	}
 	cli.SetCredentials(resp.UserID, resp.AccessToken)
 }
+
+func ExampleClient_SSORedirectURL() {
+	cli, _ := NewClient("https://matrix.org", "", "")
+	out := cli.SSORedirectURL("https://example.com/callback")
+	fmt.Println(out)
+	// Output: https://matrix.org/_matrix/client/r0/login/sso/redirect?redirectUrl=https%3A%2F%2Fexample.com%2Fcallback
+}
@@ -2,10 +2,17 @@ package gomatrix
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestClient_LeaveRoom(t *testing.T) {
@@ -63,7 +70,7 @@ func TestClient_SetAvatarUrl(t *testing.T) {
 
 func TestClient_StateEvent(t *testing.T) {
 	cli := mockClient(func(req *http.Request) (*http.Response, error) {
-		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.name" {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.name/" {
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"name":"Room Name Goes Here"}`)),
@@ -84,6 +91,32 @@ func TestClient_StateEvent(t *testing.T) {
 	}
 }
 
+func TestClient_StateEventFull(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.name/" {
+			if req.URL.Query().Get("format") != "event" {
+				return nil, fmt.Errorf("unexpected query: %s", req.URL.RawQuery)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"type":"m.room.name","state_key":"","sender":"@alice:bar","event_id":"$name","origin_server_ts":1620644706232,"content":{"name":"Room Name Goes Here"}}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	event, err := cli.StateEventFull(ctx, "!foo:bar", "m.room.name", "")
+	if err != nil {
+		t.Fatalf("StateEventFull: error, got %s", err.Error())
+	}
+	if event.Sender != "@alice:bar" || event.ID != "$name" || event.Timestamp != 1620644706232 {
+		t.Fatalf("StateEventFull: got %+v", event)
+	}
+	if event.Content["name"] != "Room Name Goes Here" {
+		t.Fatalf("StateEventFull: got content %v", event.Content)
+	}
+}
+
 func TestClient_PublicRooms(t *testing.T) {
 	cli := mockClient(func(req *http.Request) (*http.Response, error) {
 		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/publicRooms" {
@@ -155,3 +188,2170 @@ func (t MockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	return t.RT(req)
 }
+
+// mockStateClient returns a client whose homeserver stores the body of each PUT to the state event at path, and
+// returns it to GETs. Until the first PUT, GETs fail with M_NOT_FOUND.
+func mockStateClient(path string, stored *string) *Client {
+	return mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != path {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		if req.Method == "PUT" {
+			b, _ := ioutil.ReadAll(req.Body)
+			*stored = string(b)
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`))}, nil
+		}
+		if *stored == "" {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(*stored))}, nil
+	})
+}
+
+func TestClient_DownloadEventMedia(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/media/r0/download/example.org/abcdef" {
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": []string{"application/octet-stream"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`not really a png`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	ev := &Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.image",
+			"body":    "image.png",
+			"url":     "mxc://example.org/abcdef",
+			"info":    map[string]interface{}{"mimetype": "image/png"},
+		},
+	}
+	r, contentType, err := cli.DownloadEventMedia(ctx, ev)
+	if err != nil {
+		t.Fatalf("DownloadEventMedia: error, got %s", err.Error())
+	}
+	defer r.Close()
+	if contentType != "image/png" {
+		t.Fatalf("DownloadEventMedia: got content type %s, want %s", contentType, "image/png")
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "not really a png" {
+		t.Fatalf("DownloadEventMedia: got body %s", b)
+	}
+}
+
+func TestClient_SetJoinRule(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.join_rules/" {
+			var content JoinRulesEventContent
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			if content.JoinRule != JoinRuleRestricted || len(content.Allow) != 1 || content.Allow[0].RoomID != "!space:bar" {
+				return nil, fmt.Errorf("unexpected content: %+v", content)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	allow := []AllowCondition{NewRoomMembershipAllowCondition("!space:bar")}
+	if _, err := cli.SetJoinRule(ctx, "!foo:bar", JoinRuleRestricted, allow); err != nil {
+		t.Fatalf("SetJoinRule: error, got %s", err.Error())
+	}
+	if _, err := cli.SetJoinRule(ctx, "!foo:bar", JoinRuleRestricted, nil); err == nil {
+		t.Fatal("SetJoinRule: expected error for restricted rule without allow conditions")
+	}
+	if _, err := cli.SetJoinRule(ctx, "!foo:bar", "private", nil); err == nil {
+		t.Fatal("SetJoinRule: expected error for unknown join rule")
+	}
+}
+
+func TestClient_SetUserPowerLevel(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/state/m.room.power_levels/" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		if req.Method == "GET" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"ban":50,"custom_key":"keep me","users":{"@alice:bar":100}}`)),
+			}, nil
+		}
+		var content map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		users := content["users"].(map[string]interface{})
+		if users["@alice:bar"] != float64(100) || users["@bob:bar"] != float64(50) {
+			return nil, fmt.Errorf("unexpected users: %v", users)
+		}
+		if content["custom_key"] != "keep me" {
+			return nil, fmt.Errorf("custom_key was clobbered: %v", content)
+		}
+		if _, ok := content["kick"]; ok {
+			return nil, fmt.Errorf("kick was added: %v", content)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`)),
+		}, nil
+	})
+
+	if _, err := cli.SetUserPowerLevel(ctx, "!foo:bar", "@bob:bar", 50); err != nil {
+		t.Fatalf("SetUserPowerLevel: error, got %s", err.Error())
+	}
+}
+
+func TestClient_Messages(t *testing.T) {
+	var dirs []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/messages" {
+			dirs = append(dirs, req.URL.Query().Get("dir"))
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"start":"t1","chunk":[]}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	for _, dir := range []rune{DirBackward, DirForward} {
+		if _, err := cli.Messages(ctx, "!foo:bar", "t1", "", dir, 10); err != nil {
+			t.Fatalf("Messages: error, got %s", err.Error())
+		}
+	}
+	if _, err := cli.Messages(ctx, "!foo:bar", "t1", "", 'x', 10); err == nil {
+		t.Fatal("Messages: expected error for an invalid direction, got nil")
+	}
+	if got := strings.Join(dirs, ","); got != "b,f" {
+		t.Fatalf("Messages: sent dir %s, want b,f", got)
+	}
+}
+
+func TestClient_MessagesIterator(t *testing.T) {
+	pages := map[string]string{
+		"t1": `{"start":"t1","end":"t2","chunk":[{"type":"m.room.message","event_id":"$1"},{"type":"m.room.message","event_id":"$2"}]}`,
+		"t2": `{"start":"t2","end":"t3","chunk":[{"type":"m.room.message","event_id":"$3"}]}`,
+		"t3": `{"start":"t3","chunk":[]}`,
+	}
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/messages" {
+			page, ok := pages[req.URL.Query().Get("from")]
+			if !ok {
+				return nil, fmt.Errorf("unexpected from: %s", req.URL.Query().Get("from"))
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(page)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	var ids []string
+	it := cli.MessagesIterator(ctx, "!foo:bar", "t1", 'b', 2)
+	for {
+		events, ok, err := it.Next()
+		if err != nil {
+			t.Fatalf("MessagesIterator: error, got %s", err.Error())
+		}
+		if !ok {
+			break
+		}
+		for _, ev := range events {
+			ids = append(ids, ev.ID)
+		}
+	}
+	if len(ids) != 3 || ids[0] != "$1" || ids[2] != "$3" {
+		t.Fatalf("MessagesIterator: got %v, want [$1 $2 $3]", ids)
+	}
+}
+
+func TestClient_DefaultHeaders(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if got := req.Header.Get("User-Agent"); got != userAgent || !strings.HasPrefix(got, "gomatrix") {
+			return nil, fmt.Errorf("unexpected User-Agent: %s", got)
+		}
+		if got := req.Header.Get("X-Proxy-Auth"); got != "secret" {
+			return nil, fmt.Errorf("unexpected X-Proxy-Auth: %s", got)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer abcdef" {
+			return nil, fmt.Errorf("unexpected Authorization: %s", got)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+		}, nil
+	})
+	cli.DefaultHeaders = http.Header{"X-Proxy-Auth": []string{"secret"}}
+
+	if _, err := cli.LeaveRoom(ctx, "!foo:bar"); err != nil {
+		t.Fatalf("LeaveRoom: error, got %s", err.Error())
+	}
+}
+
+func TestClient_UploadBytes(t *testing.T) {
+	data := []byte("\x89PNG\x0D\x0A\x1A\x0A not really a png")
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/media/r0/upload" {
+			if got := req.Header.Get("Content-Type"); got != "image/png" {
+				return nil, fmt.Errorf("unexpected Content-Type: %s", got)
+			}
+			if req.ContentLength != int64(len(data)) {
+				return nil, fmt.Errorf("unexpected ContentLength: %d", req.ContentLength)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://example.org/abcdef"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.UploadBytes(ctx, data, "")
+	if err != nil {
+		t.Fatalf("UploadBytes: error, got %s", err.Error())
+	}
+	if resp.ContentURI != "mxc://example.org/abcdef" {
+		t.Fatalf("UploadBytes: got %s, want %s", resp.ContentURI, "mxc://example.org/abcdef")
+	}
+}
+
+func TestClient_UploadToContentRepoWithHash(t *testing.T) {
+	var uploaded string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/_matrix/media/r0/upload" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		uploaded = string(b)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"content_uri":"mxc://example.org/abcdef"}`)),
+		}, nil
+	})
+
+	resp, sum, n, err := cli.UploadToContentRepoWithHash(ctx, strings.NewReader("hello world"), "text/plain", 11)
+	if err != nil {
+		t.Fatalf("UploadToContentRepoWithHash: error, got %s", err.Error())
+	}
+	if resp.ContentURI != "mxc://example.org/abcdef" || uploaded != "hello world" {
+		t.Fatalf("UploadToContentRepoWithHash: got %s, uploaded %q", resp.ContentURI, uploaded)
+	}
+	if want := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"; sum != want || n != 11 {
+		t.Fatalf("UploadToContentRepoWithHash: got %s (%d bytes), want %s (11 bytes)", sum, n, want)
+	}
+}
+
+func TestClient_Deactivate(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/account/deactivate" {
+			var body map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			if body["auth"] == nil {
+				return &http.Response{
+					StatusCode: 401,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"flows":[{"stages":["m.login.password"]}],"session":"xyz"}`)),
+				}, nil
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"id_server_unbind_result":"success"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	_, uia, err := cli.Deactivate(ctx, nil, "")
+	if err != nil {
+		t.Fatalf("Deactivate: error, got %s", err.Error())
+	}
+	if uia == nil || !uia.HasSingleStageFlow("m.login.password") || uia.Session != "xyz" {
+		t.Fatalf("Deactivate: got UIA response %+v, want m.login.password flow", uia)
+	}
+
+	resp, uia, err := cli.Deactivate(ctx, map[string]interface{}{"type": "m.login.password", "session": uia.Session}, "")
+	if err != nil {
+		t.Fatalf("Deactivate: error, got %s", err.Error())
+	}
+	if uia != nil || resp.IDServerUnbindResult != "success" {
+		t.Fatalf("Deactivate: got %+v, %+v", resp, uia)
+	}
+
+	// A 401 without flows or a session is an ordinary error rather than a UIA response.
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 401,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}`)),
+		}, nil
+	})
+	_, uia, err = cli.Deactivate(ctx, nil, "")
+	if uia != nil || !IsMatrixError(err, ErrCodeUnknownToken) {
+		t.Fatalf("Deactivate: got %+v, %v, want an M_UNKNOWN_TOKEN error", uia, err)
+	}
+}
+
+func TestClient_IgnoreUser(t *testing.T) {
+	var stored []byte
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/user/@user:test.gomatrix.org/account_data/m.ignored_user_list" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		if req.Method == "PUT" {
+			stored, _ = ioutil.ReadAll(req.Body)
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		if stored == nil {
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Account data not found"}`)),
+			}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBuffer(stored))}, nil
+	})
+
+	ignored, err := cli.GetIgnoredUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetIgnoredUsers: error, got %s", err.Error())
+	}
+	if len(ignored) != 0 {
+		t.Fatalf("GetIgnoredUsers: got %v, want empty list", ignored)
+	}
+	if err = cli.IgnoreUser(ctx, "@spam:bar"); err != nil {
+		t.Fatalf("IgnoreUser: error, got %s", err.Error())
+	}
+	if err = cli.IgnoreUser(ctx, "@troll:bar"); err != nil {
+		t.Fatalf("IgnoreUser: error, got %s", err.Error())
+	}
+	if err = cli.UnignoreUser(ctx, "@spam:bar"); err != nil {
+		t.Fatalf("UnignoreUser: error, got %s", err.Error())
+	}
+	ignored, err = cli.GetIgnoredUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetIgnoredUsers: error, got %s", err.Error())
+	}
+	if len(ignored) != 1 || ignored[0] != "@troll:bar" {
+		t.Fatalf("GetIgnoredUsers: got %v, want [@troll:bar]", ignored)
+	}
+}
+
+func TestClient_SetStatus(t *testing.T) {
+	var body string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/presence/@user:test.gomatrix.org/status" {
+			b, _ := ioutil.ReadAll(req.Body)
+			body = strings.TrimSpace(string(b))
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if err := cli.SetStatus(ctx, "away", ""); err == nil {
+		t.Fatal("SetStatus: expected error for invalid presence, got nil")
+	}
+	if err := cli.SetStatus(ctx, PresenceUnavailable, ""); err != nil {
+		t.Fatalf("SetStatus: error, got %s", err.Error())
+	}
+	if body != `{"presence":"unavailable"}` {
+		t.Fatalf("SetStatus: got body %s, want status_msg omitted", body)
+	}
+}
+
+func TestClient_RoomSummaryFallback(t *testing.T) {
+	var paths []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.EscapedPath())
+		if req.URL.Path == "/_matrix/client/r0/publicRooms" {
+			if req.URL.Query().Get("server") != "example.org" {
+				return nil, fmt.Errorf("publicRooms: got server %q, want example.org", req.URL.Query().Get("server"))
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"chunk":[{"room_id":"!foo:bar","canonical_alias":"#foo:bar","name":"Foo","num_joined_members":3}]}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`)),
+		}, nil
+	})
+
+	resp, err := cli.RoomSummary(ctx, "#foo:bar", []string{"example.org"})
+	if err != nil {
+		t.Fatalf("RoomSummary: error, got %s", err.Error())
+	}
+	if resp.RoomID != "!foo:bar" || resp.Name != "Foo" || resp.NumJoinedMembers != 3 || resp.JoinRule != JoinRulePublic {
+		t.Fatalf("RoomSummary: got %+v", resp)
+	}
+	if len(paths) != 3 || paths[0] != "/_matrix/client/v1/room_summary/%23foo:bar" {
+		t.Fatalf("RoomSummary: got requests %v", paths)
+	}
+
+	if _, err = cli.RoomSummary(ctx, "#missing:bar", []string{"example.org"}); !IsMatrixError(err, ErrCodeUnrecognized) {
+		t.Fatalf("RoomSummary: got error %v, want the summary endpoint's error", err)
+	}
+}
+
+func TestClient_RoomSummaryDirectoryLimit(t *testing.T) {
+	pages := 0
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/_matrix/client/r0/publicRooms" {
+			// An endless directory which never contains the room.
+			pages++
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"chunk":[{"room_id":"!other:bar"}],"next_batch":"p%d"}`, pages))),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 404,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`)),
+		}, nil
+	})
+
+	if _, err := cli.RoomSummary(ctx, "#missing:bar", nil); !IsMatrixError(err, ErrCodeUnrecognized) {
+		t.Fatalf("RoomSummary: got error %v, want the summary endpoint's error", err)
+	}
+	if pages != roomSummaryMaxDirectoryPages {
+		t.Fatalf("RoomSummary: requested %d directory pages, want %d", pages, roomSummaryMaxDirectoryPages)
+	}
+}
+
+func TestClient_StartTyping(t *testing.T) {
+	var sent []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" || req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/typing/@user:test.gomatrix.org" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		sent = append(sent, strings.TrimSpace(string(b)))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+	})
+
+	typingCtx, cancel := context.WithCancel(context.Background())
+	stop, err := cli.StartTyping(typingCtx, "!foo:bar")
+	if err != nil {
+		t.Fatalf("StartTyping: error, got %s", err.Error())
+	}
+	// typing=false is still sent once the context StartTyping was called with is done.
+	cancel()
+	stop()
+	stop()
+
+	want := `{"typing":true,"timeout":30000}` + "\n" + `{"typing":false,"timeout":0}`
+	if got := strings.Join(sent, "\n"); got != want {
+		t.Fatalf("StartTyping: sent\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestClient_CreateRoomAlias(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/createRoom" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:test.gomatrix.org"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.CreateRoom(ctx, &ReqCreateRoom{RoomAliasName: "team"})
+	if err != nil {
+		t.Fatalf("CreateRoom: error, got %s", err.Error())
+	}
+	if resp.RoomID != "!foo:test.gomatrix.org" || resp.RoomAlias != "#team:test.gomatrix.org" {
+		t.Fatalf("CreateRoom: got %+v", resp)
+	}
+}
+
+func TestClient_CreateRoomIfNotExists(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		var body ReqCreateRoom
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/createRoom":
+			_ = json.NewDecoder(req.Body).Decode(&body)
+			if body.RoomAliasName == "team" {
+				return &http.Response{StatusCode: 400, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_ROOM_IN_USE","error":"Room alias already taken"}`))}, nil
+			}
+			if body.RoomAliasName == "bad name" {
+				return &http.Response{StatusCode: 400, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_INVALID_PARAM","error":"Invalid characters"}`))}, nil
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!new:test.gomatrix.org"}`))}, nil
+		case req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/directory/room/#team:test.gomatrix.org":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!existing:test.gomatrix.org","servers":["test.gomatrix.org"]}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, created, err := cli.CreateRoomIfNotExists(ctx, &ReqCreateRoom{RoomAliasName: "other"})
+	if err != nil || !created || resp.RoomID != "!new:test.gomatrix.org" {
+		t.Fatalf("CreateRoomIfNotExists: got %+v, %t, %v", resp, created, err)
+	}
+	resp, created, err = cli.CreateRoomIfNotExists(ctx, &ReqCreateRoom{RoomAliasName: "team"})
+	if err != nil || created || resp.RoomID != "!existing:test.gomatrix.org" || resp.RoomAlias != "#team:test.gomatrix.org" {
+		t.Fatalf("CreateRoomIfNotExists: got %+v, %t, %v", resp, created, err)
+	}
+	if _, _, err = cli.CreateRoomIfNotExists(ctx, &ReqCreateRoom{RoomAliasName: "bad name"}); !errors.Is(err, ErrInvalidParam) {
+		t.Fatalf("CreateRoomIfNotExists: got %v, want ErrInvalidParam", err)
+	}
+}
+
+func TestReqCreateRoom_AddInitialState(t *testing.T) {
+	req := ReqCreateRoom{
+		PowerLevelContentOverride: map[string]interface{}{"users": map[string]int{"@bot:bar": 100}},
+	}
+	if err := req.AddInitialState("m.room.guest_access", "", GuestAccessEventContent{GuestAccess: "can_join"}); err != nil {
+		t.Fatalf("AddInitialState: error, got %s", err.Error())
+	}
+	if err := req.AddInitialState("com.example.state", "key", map[string]string{"a": "b"}); err != nil {
+		t.Fatalf("AddInitialState: error, got %s", err.Error())
+	}
+	if err := req.AddInitialState("com.example.state", "bad", "not an object"); err == nil {
+		t.Fatal("AddInitialState: expected error for non-object content, got nil")
+	}
+
+	var got []string
+	for _, ev := range req.InitialState {
+		content, _ := json.Marshal(ev.Content)
+		got = append(got, fmt.Sprintf("%s/%s=%s", ev.Type, *ev.StateKey, content))
+	}
+	want := `m.room.guest_access/={"guest_access":"can_join"} com.example.state/key={"a":"b"}`
+	if strings.Join(got, " ") != want {
+		t.Fatalf("AddInitialState: got %s, want %s", strings.Join(got, " "), want)
+	}
+
+	// Only the overridden power levels are sent, not zero values for the rest.
+	b, err := json.Marshal(&req)
+	if err != nil {
+		t.Fatalf("json.Marshal: error, got %s", err.Error())
+	}
+	var body struct {
+		PowerLevelContentOverride json.RawMessage `json:"power_level_content_override"`
+	}
+	if err = json.Unmarshal(b, &body); err != nil {
+		t.Fatalf("json.Unmarshal: error, got %s", err.Error())
+	}
+	if got := string(body.PowerLevelContentOverride); got != `{"users":{"@bot:bar":100}}` {
+		t.Fatalf("PowerLevelContentOverride: sent %s", got)
+	}
+}
+
+func TestReqCreateRoom_AddInitialStateContents(t *testing.T) {
+	var req ReqCreateRoom
+	err := req.AddInitialStateContents(
+		NameEventContent{Name: "old"},
+		&TopicEventContent{Topic: "topic"},
+		JoinRulesEventContent{JoinRule: "invite"},
+	)
+	if err != nil {
+		t.Fatalf("AddInitialStateContents: error, got %s", err.Error())
+	}
+	if err = req.AddInitialStateContents(NameEventContent{Name: "new"}, RoomAvatarEventContent{URL: "mxc://bar/avatar"}); err != nil {
+		t.Fatalf("AddInitialStateContents: error, got %s", err.Error())
+	}
+	if err = req.AddInitialStateContents(TopicEventContent{Topic: "other"}, MemberEventContent{Membership: "join"}); err == nil {
+		t.Fatal("AddInitialStateContents: expected error for unsupported content, got nil")
+	}
+
+	var got []string
+	for _, ev := range req.InitialState {
+		content, _ := json.Marshal(ev.Content)
+		got = append(got, fmt.Sprintf("%s/%s=%s", ev.Type, *ev.StateKey, content))
+	}
+	want := `m.room.name/={"name":"new"} m.room.topic/={"topic":"topic"} m.room.join_rules/={"join_rule":"invite"} m.room.avatar/={"url":"mxc://bar/avatar"}`
+	if strings.Join(got, " ") != want {
+		t.Fatalf("AddInitialStateContents: got %s, want %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestClient_InviteUsers(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/invite" {
+			var body ReqInviteUser
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			if body.UserID == "@banned:bar" {
+				return &http.Response{
+					StatusCode: 403,
+					Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN","error":"User is banned"}`)),
+				}, nil
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	failed, err := cli.InviteUsers(ctx, "!foo:bar", []string{"@a:bar", "@banned:bar", "@b:bar"}, "onboarding")
+	if err != nil {
+		t.Fatalf("InviteUsers: error, got %s", err.Error())
+	}
+	if len(failed) != 1 || !IsMatrixError(failed["@banned:bar"], ErrCodeForbidden) {
+		t.Fatalf("InviteUsers: got failures %v, want only @banned:bar", failed)
+	}
+}
+
+func TestClient_JoinedRoomsSummary(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		respond := func(code int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+		}
+		switch req.URL.Path {
+		case "/_matrix/client/r0/joined_rooms":
+			return respond(200, `{"joined_rooms":["!a:bar","!b:bar","!c:bar"]}`)
+		case "/_matrix/client/r0/rooms/!a:bar/state/m.room.name/":
+			return respond(200, `{"name":"Room A"}`)
+		case "/_matrix/client/r0/rooms/!a:bar/state/m.room.avatar/":
+			return respond(200, `{"url":"mxc://bar/a"}`)
+		case "/_matrix/client/r0/rooms/!c:bar/state/m.room.name/":
+			return respond(403, `{"errcode":"M_FORBIDDEN","error":"Not in room"}`)
+		}
+		return respond(404, `{"errcode":"M_NOT_FOUND","error":"Event not found"}`)
+	})
+
+	summaries, err := cli.JoinedRoomsSummary(ctx, 2)
+	if err != nil {
+		t.Fatalf("JoinedRoomsSummary: error, got %s", err.Error())
+	}
+	if len(summaries) != 3 {
+		t.Fatalf("JoinedRoomsSummary: got %d rooms, want 3", len(summaries))
+	}
+	if a := summaries["!a:bar"]; a.Name != "Room A" || a.AvatarURL != "mxc://bar/a" || a.Err != nil {
+		t.Fatalf("JoinedRoomsSummary: got %+v for !a:bar", a)
+	}
+	if b := summaries["!b:bar"]; b.Name != "" || b.Err != nil {
+		t.Fatalf("JoinedRoomsSummary: got %+v for unnamed room !b:bar", b)
+	}
+	if c := summaries["!c:bar"]; !IsMatrixError(c.Err, ErrCodeForbidden) {
+		t.Fatalf("JoinedRoomsSummary: got %+v for !c:bar, want M_FORBIDDEN error", c)
+	}
+}
+
+func TestClient_MXCToHTTP(t *testing.T) {
+	cli := mockClient(nil)
+
+	u, err := cli.MXCToHTTP("mxc://example.org/abcdef")
+	if err != nil {
+		t.Fatalf("MXCToHTTP: error, got %s", err.Error())
+	}
+	if want := "https://test.gomatrix.org/_matrix/media/r0/download/example.org/abcdef"; u != want {
+		t.Fatalf("MXCToHTTP: got %s, want %s", u, want)
+	}
+	u, err = cli.MXCToThumbnailHTTP("mxc://example.org/abcdef", 64, 32, "crop")
+	if err != nil {
+		t.Fatalf("MXCToThumbnailHTTP: error, got %s", err.Error())
+	}
+	if want := "https://test.gomatrix.org/_matrix/media/r0/thumbnail/example.org/abcdef?height=32&method=crop&width=64"; u != want {
+		t.Fatalf("MXCToThumbnailHTTP: got %s, want %s", u, want)
+	}
+	for _, invalid := range []string{"https://example.org/abcdef", "mxc://example.org", "mxc:///abcdef", "mxc://example.org/a/b"} {
+		if _, err = cli.MXCToHTTP(invalid); err == nil {
+			t.Errorf("MXCToHTTP(%q): expected error, got nil", invalid)
+		}
+	}
+	if _, err = cli.MXCToThumbnailHTTP("mxc://example.org/abcdef", 64, 32, "stretch"); err == nil {
+		t.Fatal("MXCToThumbnailHTTP: expected error for invalid method, got nil")
+	}
+}
+
+func TestClient_SetAPIVersion(t *testing.T) {
+	cli := mockClient(nil)
+	if err := cli.SetAPIVersion("v3"); err != nil {
+		t.Fatalf("SetAPIVersion: error, got %s", err.Error())
+	}
+	if got, want := cli.BuildURL("sync"), "https://test.gomatrix.org/_matrix/client/v3/sync"; got != want {
+		t.Fatalf("BuildURL: got %s, want %s", got, want)
+	}
+	if got, want := cli.BuildMediaURL("upload"), "https://test.gomatrix.org/_matrix/media/v3/upload"; got != want {
+		t.Fatalf("BuildMediaURL: got %s, want %s", got, want)
+	}
+	if err := cli.SetAPIVersion("../admin"); err == nil {
+		t.Fatal("SetAPIVersion: expected error for invalid version, got nil")
+	}
+	if got, want := cli.Prefix, "/_matrix/client/v3"; got != want {
+		t.Fatalf("Prefix: got %s after invalid SetAPIVersion, want %s", got, want)
+	}
+}
+
+func TestClient_SendStateEventEmptyStateKey(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.topic/" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.SendStateEvent(ctx, "!foo:bar", "m.room.topic", "", map[string]string{"topic": "hello"})
+	if err != nil {
+		t.Fatalf("SendStateEvent: error, got %s", err.Error())
+	}
+	if resp.EventID != "$abc" {
+		t.Fatalf("SendStateEvent: got event ID %s, want $abc", resp.EventID)
+	}
+	if got, want := cli.BuildURL("rooms", "!foo:bar", "state", "m.room.member", "@user:bar"), "https://test.gomatrix.org/_matrix/client/r0/rooms/%21foo:bar/state/m.room.member/@user:bar"; got != want {
+		t.Fatalf("BuildURL: got %s, want %s", got, want)
+	}
+}
+
+func TestClient_SetState(t *testing.T) {
+	var requests int
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		requests++
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.name/" && string(body) == `{"name":"hello"}`+"\n" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled request: %s %s %s", req.Method, req.URL.Path, body)
+	})
+
+	resp, err := cli.SetState(ctx, "!foo:bar", "m.room.name", "", map[string]string{"name": "hello"})
+	if err != nil {
+		t.Fatalf("SetState: error, got %s", err.Error())
+	}
+	if resp.EventID != "$abc" {
+		t.Fatalf("SetState: got event ID %s, want $abc", resp.EventID)
+	}
+
+	_, err = cli.SetState(ctx, "!foo:bar", "m.room.name", "", map[string]interface{}{"name": make(chan int)})
+	var contentErr *ContentError
+	if !errors.As(err, &contentErr) || contentErr.EventType != "m.room.name" {
+		t.Fatalf("SetState: got %v, want a *ContentError", err)
+	}
+	if requests != 1 {
+		t.Fatalf("SetState: made %d requests, want 1", requests)
+	}
+}
+
+func TestClient_BuildURLEscaping(t *testing.T) {
+	cli := mockClient(nil)
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{cli.BuildURL("logout", "all"), "https://test.gomatrix.org/_matrix/client/r0/logout/all"},
+		{cli.BuildURL("logout/all"), "https://test.gomatrix.org/_matrix/client/r0/logout%2Fall"},
+		{cli.BuildURL("directory", "room", "#foo:bar.com"), "https://test.gomatrix.org/_matrix/client/r0/directory/room/%23foo:bar.com"},
+		{cli.BuildURL("profile", "@a/b?c:bar.com", "displayname"), "https://test.gomatrix.org/_matrix/client/r0/profile/@a%2Fb%3Fc:bar.com/displayname"},
+		{cli.BuildURL("rooms", "!foo:bar", "event", "$abc/def+ghi"), "https://test.gomatrix.org/_matrix/client/r0/rooms/%21foo:bar/event/$abc%2Fdef+ghi"},
+		{cli.BuildBaseURL("_matrix/client/r0", "directory", "room", "#foo:bar.com"), "https://test.gomatrix.org/_matrix/client/r0/directory/room/%23foo:bar.com"},
+		{cli.BuildURLWithQuery([]string{"rooms", "#a:b", "messages"}, map[string]string{"dir": "b"}), "https://test.gomatrix.org/_matrix/client/r0/rooms/%23a:b/messages?dir=b"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("got %s, want %s", test.got, test.want)
+		}
+	}
+
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.EscapedPath() == "/_matrix/client/r0/profile/@a%2Fb:bar.com/displayname" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"displayname":"A/B"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.EscapedPath())
+	})
+	resp, err := cli.GetDisplayName(ctx, "@a/b:bar.com")
+	if err != nil {
+		t.Fatalf("GetDisplayName: error, got %s", err.Error())
+	}
+	if resp.DisplayName != "A/B" {
+		t.Fatalf("GetDisplayName: got %s, want A/B", resp.DisplayName)
+	}
+}
+
+func TestClient_RefreshToken(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/_matrix/client/v3/refresh" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		var body ReqRefresh
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		if body.RefreshToken != "r1" {
+			return nil, fmt.Errorf("got refresh token %q, want r1", body.RefreshToken)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"access_token":"a2","refresh_token":"r2","expires_in_ms":60000}`)),
+		}, nil
+	})
+
+	// The client is still on the r0 prefix.
+	resp, err := cli.RefreshToken(ctx, "r1")
+	if err != nil {
+		t.Fatalf("RefreshToken: error, got %s", err.Error())
+	}
+	if resp.AccessToken != "a2" || resp.RefreshToken != "r2" {
+		t.Fatalf("RefreshToken: got %+v", resp)
+	}
+}
+
+func TestClient_LogoutAll(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.EscapedPath() == "/_matrix/client/r0/logout/all" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.EscapedPath())
+	})
+	if _, err := cli.LogoutAll(ctx); err != nil {
+		t.Fatalf("LogoutAll: error, got %s", err.Error())
+	}
+}
+
+func TestClient_RequestTimeout(t *testing.T) {
+	var deadlines []time.Time
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		deadline, _ := req.Context().Deadline()
+		deadlines = append(deadlines, deadline)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s1"}`))}, nil
+	})
+	cli.RequestTimeout = time.Minute
+
+	start := time.Now()
+	if _, err := cli.JoinedRooms(context.Background()); err != nil {
+		t.Fatalf("JoinedRooms: error, got %s", err.Error())
+	}
+	longCtx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	if _, err := cli.JoinedRooms(longCtx); err != nil {
+		t.Fatalf("JoinedRooms: error, got %s", err.Error())
+	}
+	if _, err := cli.SyncRequest(context.Background(), 30000, "", "", false, ""); err != nil {
+		t.Fatalf("SyncRequest: error, got %s", err.Error())
+	}
+
+	if d := deadlines[0].Sub(start); d < time.Minute || d > time.Minute+time.Second {
+		t.Errorf("RequestTimeout: got deadline in %s, want %s", d, time.Minute)
+	}
+	if d := deadlines[1].Sub(start); d <= 2*time.Minute {
+		t.Errorf("RequestTimeout: shortened an existing deadline to %s", d)
+	}
+	if !deadlines[2].IsZero() {
+		t.Errorf("RequestTimeout: applied to /sync")
+	}
+}
+
+func TestClient_DisableMediaCompression(t *testing.T) {
+	var (
+		mediaAcceptEncoding string
+		forceGzip           bool // compress media even if the client didn't ask for it, like a misbehaving proxy
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch {
+		case r.URL.Path == "/_matrix/client/r0/joined_rooms":
+			w.Header().Set("Content-Type", "application/json")
+			body = `{"joined_rooms":["!foo:bar"]}`
+		case strings.HasPrefix(r.URL.Path, "/_matrix/media/r0/download/"):
+			mediaAcceptEncoding = r.Header.Get("Accept-Encoding")
+			w.Header().Set("Content-Type", "text/plain")
+			body = "media bytes"
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		if !forceGzip && !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(body))
+		gz.Close()
+	}))
+	defer srv.Close()
+	cli, _ := NewClient(srv.URL, "@user:test.gomatrix.org", "abcdef")
+	cli.Client = srv.Client()
+	cli.DisableMediaCompression = true
+
+	rooms, err := cli.JoinedRooms(ctx)
+	if err != nil {
+		t.Fatalf("JoinedRooms: error, got %s", err.Error())
+	}
+	if len(rooms.JoinedRooms) != 1 || rooms.JoinedRooms[0] != "!foo:bar" {
+		t.Fatalf("JoinedRooms: got %v from gzipped response", rooms.JoinedRooms)
+	}
+
+	ev := &Event{Type: "m.room.message", Content: map[string]interface{}{"msgtype": "m.file", "url": "mxc://bar/abc"}}
+	r, _, err := cli.DownloadEventMedia(ctx, ev)
+	if err != nil {
+		t.Fatalf("DownloadEventMedia: error, got %s", err.Error())
+	}
+	defer r.Close()
+	if b, _ := ioutil.ReadAll(r); string(b) != "media bytes" {
+		t.Fatalf("DownloadEventMedia: got %q, want uncompressed media bytes", b)
+	}
+	if mediaAcceptEncoding != "identity" {
+		t.Fatalf("DownloadEventMedia: sent Accept-Encoding %q, want identity", mediaAcceptEncoding)
+	}
+
+	forceGzip = true
+	if _, _, err = cli.DownloadEventMedia(ctx, ev); err == nil || !strings.Contains(err.Error(), "Content-Encoding") {
+		t.Fatalf("DownloadEventMedia: got %v, want an error for a gzipped response", err)
+	}
+}
+
+func TestClient_MakeFullRequest(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/directory/room/#foo:bar" {
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{"Location": []string{"/_matrix/client/r0/directory/room/%23foo:bar"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 404,
+			Header:     http.Header{"Etag": []string{"abc"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Not found"}`)),
+		}, nil
+	})
+
+	var out map[string]interface{}
+	res, body, err := cli.MakeFullRequest(ctx, FullRequest{
+		Method:       "PUT",
+		URL:          cli.BuildURL("directory", "room", "#foo:bar"),
+		RequestJSON:  map[string]string{"room_id": "!foo:bar"},
+		ResponseJSON: &out,
+	})
+	if err != nil {
+		t.Fatalf("MakeFullRequest: error, got %s", err.Error())
+	}
+	if res.StatusCode != 200 || res.Header.Get("Location") == "" || string(body) != "{}" || out == nil {
+		t.Fatalf("MakeFullRequest: got status %d, headers %v, body %s", res.StatusCode, res.Header, body)
+	}
+
+	res, body, err = cli.MakeFullRequest(ctx, FullRequest{Method: "GET", URL: cli.BuildURL("missing")})
+	if !IsMatrixError(err, ErrCodeNotFound) {
+		t.Fatalf("MakeFullRequest: got error %v, want M_NOT_FOUND", err)
+	}
+	if res == nil || res.Header.Get("ETag") != "abc" || !strings.Contains(string(body), "M_NOT_FOUND") {
+		t.Fatalf("MakeFullRequest: got response %v and body %s for error", res, body)
+	}
+}
+
+func TestClient_JoinRoomWithReq(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/join/!foo:bar" {
+			var body map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				return nil, err
+			}
+			signed, _ := body["third_party_signed"].(map[string]interface{})
+			if body["reason"] != "hi" || signed["token"] != "tok" || signed["mxid"] != "@user:test.gomatrix.org" {
+				return nil, fmt.Errorf("unexpected body: %v", body)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.JoinRoomWithReq(ctx, "!foo:bar", "", &ReqJoinRoom{
+		Reason: "hi",
+		ThirdPartySigned: &ThirdPartySigned{
+			Sender:     "@inviter:bar",
+			MXID:       "@user:test.gomatrix.org",
+			Token:      "tok",
+			Signatures: map[string]map[string]string{"id.example.org": {"ed25519:0": "sig"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("JoinRoomWithReq: error, got %s", err.Error())
+	}
+	if resp.RoomID != "!foo:bar" {
+		t.Fatalf("JoinRoomWithReq: got room ID %s", resp.RoomID)
+	}
+}
+
+func TestClient_JoinRoomVia(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/join/#foo:bar" {
+			if via := req.URL.Query()["server_name"]; len(via) != 2 || via[0] != "bar" || via[1] != "example.org" {
+				return nil, fmt.Errorf("unexpected server_name params: %v", via)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar"}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if _, err := cli.JoinRoomVia(ctx, "#foo:bar", []string{"bar", "example.org"}, nil); err != nil {
+		t.Fatalf("JoinRoomVia: error, got %s", err.Error())
+	}
+}
+
+func TestClient_Versions(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/versions" {
+			return &http.Response{
+				StatusCode: 200,
+				Body: ioutil.NopCloser(bytes.NewBufferString(`{
+					"versions": ["r0.6.1", "v1.4", "v1.5"],
+					"unstable_features": {"org.matrix.msc3440.stable": true, "org.matrix.msc2716": false}
+				}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.Versions(ctx)
+	if err != nil {
+		t.Fatalf("Versions: error, got %s", err.Error())
+	}
+	if !resp.Supports("v1.5") || resp.Supports("v1.6") {
+		t.Fatalf("Supports: got wrong result for %v", resp.Versions)
+	}
+	if !resp.HasUnstableFeature("org.matrix.msc3440.stable") || resp.HasUnstableFeature("org.matrix.msc2716") || resp.HasUnstableFeature("unknown") {
+		t.Fatalf("HasUnstableFeature: got wrong result for %v", resp.UnstableFeatures)
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	status := 200
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/versions" {
+			return &http.Response{StatusCode: status, Body: ioutil.NopCloser(bytes.NewBufferString(`{"versions":["v1.5"]}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if err := cli.Ping(ctx); err != nil {
+		t.Fatalf("Ping: error, got %s", err.Error())
+	}
+	status = 502
+	if err, ok := cli.Ping(ctx).(*HTTPError); !ok || err.Code != 502 {
+		t.Fatalf("Ping: got %v, want *HTTPError with code 502", err)
+	}
+}
+
+func TestClient_SetRoomAvatar(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "PUT" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.avatar/" {
+			var content RoomAvatarEventContent
+			if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+				return nil, err
+			}
+			if content.URL != "mxc://bar/avatar" || content.Info == nil || content.Info.Mimetype != "image/png" {
+				return nil, fmt.Errorf("unexpected content: %+v", content)
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if _, err := cli.SetRoomAvatar(ctx, "!foo:bar", "mxc://bar/avatar", &ImageInfo{Mimetype: "image/png"}); err != nil {
+		t.Fatalf("SetRoomAvatar: error, got %s", err.Error())
+	}
+	if _, err := cli.SetRoomAvatar(ctx, "!foo:bar", "https://bar/avatar.png", nil); err == nil {
+		t.Fatal("SetRoomAvatar: expected error for non-mxc URL, got nil")
+	}
+}
+
+func TestClient_RoomVersion(t *testing.T) {
+	content := `{"creator":"@user:bar","room_version":"9","predecessor":{"room_id":"!old:bar","event_id":"$tomb"}}`
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.create/" {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(content))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if version, err := cli.RoomVersion(ctx, "!foo:bar"); err != nil || version != "9" {
+		t.Fatalf("RoomVersion: got %q, %v, want 9", version, err)
+	}
+	content = `{"creator":"@user:bar"}`
+	if version, err := cli.RoomVersion(ctx, "!foo:bar"); err != nil || version != "1" {
+		t.Fatalf("RoomVersion: got %q, %v, want 1 for a room without room_version", version, err)
+	}
+}
+
+func TestClient_IsEncrypted(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/_matrix/client/r0/rooms/!enc:bar/state/m.room.encryption/":
+			if req.Method == "PUT" {
+				var content EncryptionEventContent
+				if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+					return nil, err
+				}
+				if content.Algorithm != AlgorithmMegolmV1 || content.RotationPeriodMsgs != 100 {
+					return nil, fmt.Errorf("unexpected content: %+v", content)
+				}
+				return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`))}, nil
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"algorithm":"m.megolm.v1.aes-sha2"}`))}, nil
+		case "/_matrix/client/r0/rooms/!plain:bar/state/m.room.encryption/":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	if encrypted, err := cli.IsEncrypted(ctx, "!enc:bar"); err != nil || !encrypted {
+		t.Fatalf("IsEncrypted: got %v, %v for an encrypted room", encrypted, err)
+	}
+	if encrypted, err := cli.IsEncrypted(ctx, "!plain:bar"); err != nil || encrypted {
+		t.Fatalf("IsEncrypted: got %v, %v for an unencrypted room", encrypted, err)
+	}
+	if _, err := cli.EnableEncryption(ctx, "!enc:bar", 100, 0); err != nil {
+		t.Fatalf("EnableEncryption: error, got %s", err.Error())
+	}
+}
+
+func TestClient_GuestAccess(t *testing.T) {
+	var stored string
+	cli := mockStateClient("/_matrix/client/r0/rooms/!foo:bar/state/m.room.guest_access/", &stored)
+
+	if allowed, err := cli.GuestAccess(ctx, "!foo:bar"); err != nil || allowed {
+		t.Fatalf("GuestAccess: got %v, %v, want false without an event", allowed, err)
+	}
+	if _, err := cli.SetGuestAccess(ctx, "!foo:bar", true); err != nil {
+		t.Fatalf("SetGuestAccess: error, got %s", err.Error())
+	}
+	if !strings.Contains(stored, `"guest_access":"can_join"`) {
+		t.Fatalf("SetGuestAccess: sent %s", stored)
+	}
+	if allowed, err := cli.GuestAccess(ctx, "!foo:bar"); err != nil || !allowed {
+		t.Fatalf("GuestAccess: got %v, %v, want true", allowed, err)
+	}
+}
+
+func TestClient_CanonicalAlias(t *testing.T) {
+	var stored string
+	cli := mockStateClient("/_matrix/client/r0/rooms/!foo:bar/state/m.room.canonical_alias/", &stored)
+
+	content, err := cli.CanonicalAlias(ctx, "!foo:bar")
+	if err != nil || content.Alias != "" {
+		t.Fatalf("CanonicalAlias: got %+v, %v, want empty content", content, err)
+	}
+	if _, err = cli.SetCanonicalAlias(ctx, "!foo:bar", "#foo:bar", []string{"#foo2:bar"}); err != nil {
+		t.Fatalf("SetCanonicalAlias: error, got %s", err.Error())
+	}
+	content, err = cli.CanonicalAlias(ctx, "!foo:bar")
+	if err != nil || content.Alias != "#foo:bar" || len(content.AltAliases) != 1 || content.AltAliases[0] != "#foo2:bar" {
+		t.Fatalf("CanonicalAlias: got %+v, %v", content, err)
+	}
+}
+
+func TestClient_PinnedEvents(t *testing.T) {
+	var stored string
+	cli := mockStateClient("/_matrix/client/r0/rooms/!foo:bar/state/m.room.pinned_events/", &stored)
+
+	pinned, err := cli.PinnedEvents(ctx, "!foo:bar")
+	if err != nil || pinned == nil || len(pinned) != 0 {
+		t.Fatalf("PinnedEvents: got %v, %v, want empty list", pinned, err)
+	}
+	if _, err = cli.SetPinnedEvents(ctx, "!foo:bar", []string{"$a", "$b"}); err != nil {
+		t.Fatalf("SetPinnedEvents: error, got %s", err.Error())
+	}
+	pinned, err = cli.PinnedEvents(ctx, "!foo:bar")
+	if err != nil || len(pinned) != 2 || pinned[0] != "$a" || pinned[1] != "$b" {
+		t.Fatalf("PinnedEvents: got %v, %v", pinned, err)
+	}
+}
+
+func TestNewClient_Transport(t *testing.T) {
+	cli, _ := NewClient("https://test.gomatrix.org", "@user:test.gomatrix.org", "abcdef")
+	if cli.Client == http.DefaultClient {
+		t.Fatal("NewClient: uses http.DefaultClient, want a dedicated client")
+	}
+	if _, ok := cli.Client.Transport.(*http.Transport); !ok || cli.Client.Transport == http.DefaultTransport {
+		t.Fatalf("NewClient: got transport %T, want a dedicated *http.Transport", cli.Client.Transport)
+	}
+
+	cli.Client = http.DefaultClient
+	transport := NewTransport()
+	transport.MaxIdleConnsPerHost = 50
+	cli.SetTransport(transport)
+	if cli.Client == http.DefaultClient || http.DefaultClient.Transport != nil {
+		t.Fatal("SetTransport: modified http.DefaultClient")
+	}
+	if cli.Client.Transport != transport {
+		t.Fatal("SetTransport: transport was not set")
+	}
+}
+
+func TestClient_SyncContextCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		// Long-poll until the request is cancelled.
+		started <- struct{}{}
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	cli.InlineFilter = json.RawMessage(`{}`)
+
+	syncCtx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- cli.Sync(syncCtx) }()
+	<-started
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Fatalf("Sync: got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Sync: did not return after ctx was cancelled")
+	}
+	if n := cli.ConsecutiveSyncFailures(); n != 0 {
+		t.Fatalf("ConsecutiveSyncFailures: got %d, want 0", n)
+	}
+}
+
+func TestClient_StopSync(t *testing.T) {
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A slow homeserver which holds the long-poll open until the client goes away.
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(30 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	cli, _ := NewClient(srv.URL, "@user:test.gomatrix.org", "abcdef")
+	cli.InlineFilter = json.RawMessage(`{}`)
+
+	errs := make(chan error, 1)
+	go func() { errs <- cli.Sync(context.Background()) }()
+	<-started
+	start := time.Now()
+	cli.StopSync()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Sync: got %s after StopSync, want nil", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("StopSync: Sync took %s to return", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StopSync: Sync did not return")
+	}
+	if n := cli.ConsecutiveSyncFailures(); n != 0 {
+		t.Fatalf("ConsecutiveSyncFailures: got %d, want 0", n)
+	}
+}
+
+func TestClient_OnSyncComplete(t *testing.T) {
+	var requests int
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf(`{"next_batch":"s%d"}`, requests))),
+		}, nil
+	})
+	cli.InlineFilter = json.RawMessage(`{}`)
+
+	var completed []bool
+	cli.OnSyncComplete = func(isInitial bool) {
+		completed = append(completed, isInitial)
+		if len(completed) == 2 {
+			cli.StopSync()
+		}
+	}
+	if err := cli.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync: error, got %s", err.Error())
+	}
+	if len(completed) != 2 || !completed[0] || completed[1] {
+		t.Fatalf("OnSyncComplete: got %v, want [true false]", completed)
+	}
+}
+
+func TestClient_OnSyncSuccess(t *testing.T) {
+	var (
+		cli      *Client
+		failures []int
+	)
+	cli = mockClient(func(req *http.Request) (*http.Response, error) {
+		failures = append(failures, cli.ConsecutiveSyncFailures())
+		if len(failures) <= 2 {
+			return &http.Response{
+				StatusCode: 500,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNKNOWN","error":"Internal error"}`)),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s1"}`)),
+		}, nil
+	})
+	cli.InlineFilter = json.RawMessage(`{}`)
+	syncer := cli.Syncer.(*DefaultSyncer)
+	syncer.BackoffBase = time.Millisecond
+	syncer.BackoffMax = time.Millisecond
+
+	var successes []string
+	cli.OnSyncSuccess = func(nextBatch string, duration time.Duration) {
+		successes = append(successes, fmt.Sprintf("%s %d", nextBatch, cli.ConsecutiveSyncFailures()))
+		if duration < 0 {
+			t.Errorf("OnSyncSuccess: got negative duration %s", duration)
+		}
+		cli.StopSync()
+	}
+	if err := cli.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync: error, got %s", err.Error())
+	}
+	if fmt.Sprint(failures) != "[0 1 2]" {
+		t.Fatalf("ConsecutiveSyncFailures: got %v before each request, want [0 1 2]", failures)
+	}
+	if len(successes) != 1 || successes[0] != "s1 0" {
+		t.Fatalf("OnSyncSuccess: got %v, want [s1 0]", successes)
+	}
+}
+
+func TestClient_GetFilter(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/_matrix/client/r0/user/@alice:bar/filter/f1":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room":{"timeline":{"limit":10}}}`))}, nil
+		case "/_matrix/client/r0/user/@alice:bar/filter/stale":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"No such filter"}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	raw, err := cli.GetFilter(ctx, "@alice:bar", "f1")
+	if err != nil {
+		t.Fatalf("GetFilter: error, got %s", err.Error())
+	}
+	var filter Filter
+	if err = json.Unmarshal(raw, &filter); err != nil {
+		t.Fatalf("GetFilter: invalid filter %s: %s", raw, err)
+	}
+	if filter.Room.Timeline.Limit != 10 {
+		t.Fatalf("GetFilter: got %s", raw)
+	}
+	if _, err = cli.GetFilter(ctx, "@alice:bar", "stale"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetFilter: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestClient_SyncFilter(t *testing.T) {
+	var filters []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/user/@user:test.gomatrix.org/filter" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"filter_id":"f2"}`)),
+			}, nil
+		}
+		if req.URL.Path != "/_matrix/client/r0/sync" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		filters = append(filters, req.URL.Query().Get("filter"))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s1"}`)),
+		}, nil
+	})
+	cli.OnSyncComplete = func(bool) {
+		cli.StopSync()
+	}
+
+	// A filter is created and saved on the first sync, then reused.
+	for i := 0; i < 2; i++ {
+		if err := cli.Sync(context.Background()); err != nil {
+			t.Fatalf("Sync: error, got %s", err.Error())
+		}
+	}
+	if got := cli.Store.LoadFilterID(cli.UserID); got != "f2" {
+		t.Fatalf("LoadFilterID: got %q, want f2", got)
+	}
+
+	cli.InlineFilter = json.RawMessage(`{ "room": {"timeline": {"limit": 5}} }`)
+	if err := cli.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync: error, got %s", err.Error())
+	}
+	want := []string{"f2", "f2", `{"room":{"timeline":{"limit":5}}}`}
+	if strings.Join(filters, " ") != strings.Join(want, " ") {
+		t.Fatalf("Sync: sent filters %q, want %q", filters, want)
+	}
+}
+
+func TestClient_SyncLazyLoadMembers(t *testing.T) {
+	var syncFilters []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/user/@user:test.gomatrix.org/filter" {
+			var filter Filter
+			if err := json.NewDecoder(req.Body).Decode(&filter); err != nil {
+				return nil, err
+			}
+			if !filter.Room.State.LazyLoadMembers {
+				return nil, fmt.Errorf("lazy_load_members not set in created filter: %+v", filter.Room)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"filter_id":"f3"}`)),
+			}, nil
+		}
+		if req.URL.Path != "/_matrix/client/r0/sync" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		syncFilters = append(syncFilters, req.URL.Query().Get("filter"))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s1"}`)),
+		}, nil
+	})
+	syncer := cli.Syncer.(*DefaultSyncer)
+	syncer.LazyLoadMembers = true
+	cli.OnSyncComplete = func(bool) {
+		cli.StopSync()
+	}
+	if err := cli.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync: error, got %s", err.Error())
+	}
+
+	// The same filter can be sent inline instead.
+	cli.InlineFilter = syncer.GetFilterJSON(cli.UserID)
+	if err := cli.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync: error, got %s", err.Error())
+	}
+	if len(syncFilters) != 2 || syncFilters[0] != "f3" {
+		t.Fatalf("Sync: sent filters %q, want f3 then the inline filter", syncFilters)
+	}
+	var filter Filter
+	if err := json.Unmarshal([]byte(syncFilters[1]), &filter); err != nil {
+		t.Fatalf("Sync: invalid inline filter %q: %s", syncFilters[1], err)
+	}
+	if !filter.Room.State.LazyLoadMembers || !filter.Room.Timeline.LazyLoadMembers {
+		t.Fatalf("Sync: lazy_load_members not set in inline filter %q", syncFilters[1])
+	}
+}
+
+func TestClient_ForceFullSync(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/user/@user:test.gomatrix.org/filter" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"filter_id":"f1"}`)),
+			}, nil
+		}
+		q := req.URL.Query()
+		if req.URL.Path != "/_matrix/client/r0/sync" || q.Has("since") || q.Get("full_state") != "true" || q.Get("timeout") != "0" || q.Get("filter") != "f1" {
+			return nil, fmt.Errorf("unhandled request: %s", req.URL)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"next_batch":"s2","rooms":{"join":{"!foo:bar":{}}}}`)),
+		}, nil
+	})
+	cli.Store.SaveNextBatch(cli.UserID, "s1")
+
+	// As with Sync, the filter is created and saved as there is none yet.
+	resp, err := cli.ForceFullSync(ctx)
+	if err != nil {
+		t.Fatalf("ForceFullSync: error, got %s", err.Error())
+	}
+	if _, ok := resp.Rooms.Join["!foo:bar"]; !ok || resp.NextBatch != "s2" {
+		t.Fatalf("ForceFullSync: got %+v", resp)
+	}
+	if got := cli.Store.LoadNextBatch(cli.UserID); got != "s1" {
+		t.Fatalf("ForceFullSync: changed the saved next_batch to %s", got)
+	}
+	if got := cli.Store.LoadFilterID(cli.UserID); got != "f1" {
+		t.Fatalf("ForceFullSync: saved filter ID %q, want f1", got)
+	}
+}
+
+func TestClient_RoomStateByType(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "GET" || req.URL.Path != "/_matrix/client/r0/rooms/!space:bar/state" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`[
+				{"type":"m.room.create","state_key":"","event_id":"$1","content":{"type":"m.space"}},
+				{"type":"m.space.child","state_key":"!a:bar","event_id":"$2","content":{"via":["bar"]}},
+				{"type":"m.space.child","state_key":"!b:bar","event_id":"$3","content":{"via":["bar"]}}
+			]`)),
+		}, nil
+	})
+
+	events, err := cli.RoomStateByType(ctx, "!space:bar", "m.space.child")
+	if err != nil {
+		t.Fatalf("RoomStateByType: error, got %s", err.Error())
+	}
+	if len(events) != 2 || *events[0].StateKey != "!a:bar" || *events[1].StateKey != "!b:bar" {
+		t.Fatalf("RoomStateByType: got %+v", events)
+	}
+	if events, err = cli.RoomStateByType(ctx, "!space:bar", "m.room.topic"); err != nil || len(events) != 0 {
+		t.Fatalf("RoomStateByType: got %+v, %v, want no events", events, err)
+	}
+}
+
+func TestClient_SendTextWithMentions(t *testing.T) {
+	var bodies []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" || !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/") {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, strings.TrimSpace(string(b)))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`))}, nil
+	})
+
+	if _, err := cli.SendTextWithMentions(ctx, "!foo:bar", "hi alice", []string{"@alice:bar"}, false); err != nil {
+		t.Fatalf("SendTextWithMentions: error, got %s", err.Error())
+	}
+	if _, err := cli.SendTextWithMentions(ctx, "!foo:bar", "hi alice", nil, false); err != nil {
+		t.Fatalf("SendTextWithMentions: error, got %s", err.Error())
+	}
+	if _, err := cli.SendText(ctx, "!foo:bar", "hi"); err != nil {
+		t.Fatalf("SendText: error, got %s", err.Error())
+	}
+	want := []string{
+		`{"msgtype":"m.text","body":"hi alice","formatted_body":"","format":"","m.mentions":{"user_ids":["@alice:bar"]}}`,
+		`{"msgtype":"m.text","body":"hi alice","formatted_body":"","format":"","m.mentions":{}}`,
+		`{"msgtype":"m.text","body":"hi","formatted_body":"","format":""}`,
+	}
+	if strings.Join(bodies, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("SendTextWithMentions: got\n%s\nwant\n%s", strings.Join(bodies, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClient_SendMessageEventWithTxn(t *testing.T) {
+	var paths []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		paths = append(paths, req.URL.EscapedPath())
+		// The homeserver returns the original event for a retried transaction.
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`))}, nil
+	})
+
+	content := TextMessage{MsgType: "m.text", Body: "hi"}
+	for i := 0; i < 2; i++ {
+		resp, err := cli.SendMessageEventWithTxn(ctx, "!foo:bar", "m.room.message", "my/txn", content)
+		if err != nil {
+			t.Fatalf("SendMessageEventWithTxn: error, got %s", err.Error())
+		}
+		if resp.EventID != "$abc" {
+			t.Fatalf("SendMessageEventWithTxn: got event ID %s, want $abc", resp.EventID)
+		}
+	}
+	want := "/_matrix/client/r0/rooms/%21foo:bar/send/m.room.message/my%2Ftxn"
+	if len(paths) != 2 || paths[0] != want || paths[1] != want {
+		t.Fatalf("SendMessageEventWithTxn: got paths %v, want %s twice", paths, want)
+	}
+}
+
+func TestClient_SendFormattedNotice(t *testing.T) {
+	var body string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" || !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/") {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		body = strings.TrimSpace(string(b))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`))}, nil
+	})
+
+	resp, err := cli.SendFormattedNotice(ctx, "!foo:bar", "build passed", "<b>build</b> passed")
+	if err != nil {
+		t.Fatalf("SendFormattedNotice: error, got %s", err.Error())
+	}
+	if resp.EventID != "$abc" {
+		t.Fatalf("SendFormattedNotice: got event ID %s, want $abc", resp.EventID)
+	}
+	want := `{"msgtype":"m.notice","body":"build passed","formatted_body":"\u003cb\u003ebuild\u003c/b\u003e passed","format":"org.matrix.custom.html"}`
+	if body != want {
+		t.Fatalf("SendFormattedNotice: sent %s, want %s", body, want)
+	}
+}
+
+func TestClient_AddSpaceChildAndParent(t *testing.T) {
+	var sent []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "PUT" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		sent = append(sent, req.URL.Path+" "+strings.TrimSpace(string(b)))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$abc"}`))}, nil
+	})
+
+	if _, err := cli.AddSpaceChild(ctx, "!space:bar", "!child:bar", []string{"bar"}, "a", true); err != nil {
+		t.Fatalf("AddSpaceChild: error, got %s", err.Error())
+	}
+	if _, err := cli.AddSpaceParent(ctx, "!child:bar", "!space:bar", []string{"bar", "baz"}, true); err != nil {
+		t.Fatalf("AddSpaceParent: error, got %s", err.Error())
+	}
+	if _, err := cli.AddSpaceChild(ctx, "!space:bar", "!child:bar", nil, "", false); err == nil {
+		t.Fatal("AddSpaceChild: expected error without via servers, got nil")
+	}
+	if _, err := cli.AddSpaceParent(ctx, "!child:bar", "!space:bar", nil, false); err == nil {
+		t.Fatal("AddSpaceParent: expected error without via servers, got nil")
+	}
+
+	want := []string{
+		`/_matrix/client/r0/rooms/!space:bar/state/m.space.child/!child:bar {"via":["bar"],"order":"a","suggested":true}`,
+		`/_matrix/client/r0/rooms/!child:bar/state/m.space.parent/!space:bar {"via":["bar","baz"],"canonical":true}`,
+	}
+	if strings.Join(sent, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("AddSpaceChild/AddSpaceParent: sent\n%s\nwant\n%s", strings.Join(sent, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClient_HierarchyPagination(t *testing.T) {
+	var queries []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "GET" || req.URL.Path != "/_matrix/client/r0/rooms/!space:bar/hierarchy" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		queries = append(queries, req.URL.RawQuery)
+		body := `{"rooms":[{"room_id":"!space:bar","name":"Space"},{"room_id":"!a:bar"}],"next_batch":"p2"}`
+		if req.URL.Query().Get("from") == "p2" {
+			body = `{"rooms":[{"room_id":"!b:bar"}]}`
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(body))}, nil
+	})
+
+	var rooms []string
+	req := ReqHierarchy{RoomId: "!space:bar", Limit: 2, MaxDepth: 1}
+	for {
+		resp, err := cli.Hierarchy(ctx, req)
+		if err != nil {
+			t.Fatalf("Hierarchy: error, got %s", err.Error())
+		}
+		for _, room := range resp.Rooms {
+			rooms = append(rooms, room.RoomId)
+		}
+		if resp.NextBatch == "" {
+			break
+		}
+		req.From = resp.NextBatch
+	}
+
+	if got := strings.Join(rooms, ","); got != "!space:bar,!a:bar,!b:bar" {
+		t.Fatalf("Hierarchy: got rooms %s", got)
+	}
+	want := []string{
+		"limit=2&max_depth=1&suggested_only=false",
+		"from=p2&limit=2&max_depth=1&suggested_only=false",
+	}
+	if strings.Join(queries, " ") != strings.Join(want, " ") {
+		t.Fatalf("Hierarchy: got queries %v, want %v", queries, want)
+	}
+}
+
+func TestClient_KickBanPrecheck(t *testing.T) {
+	var sent []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.power_levels/":
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"kick":50,"ban":75,"users":{"@user:test.gomatrix.org":60,"@admin:bar":100}}`)),
+			}, nil
+		case req.Method == "POST" && (req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/kick" || req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/ban"):
+			b, _ := ioutil.ReadAll(req.Body)
+			sent = append(sent, strings.TrimSpace(string(b)))
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+	cli.PrecheckPermissions = true
+	cli.DefaultModerationReason = "spam"
+
+	req := &ReqKickUser{UserID: "@spammer:bar"}
+	if _, err := cli.KickUser(ctx, "!foo:bar", req); err != nil {
+		t.Fatalf("KickUser: error, got %s", err.Error())
+	}
+	if req.Reason != "" {
+		t.Fatalf("KickUser: modified the request reason to %q", req.Reason)
+	}
+	var permErr *PermissionError
+	if _, err := cli.KickUser(ctx, "!foo:bar", &ReqKickUser{UserID: "@admin:bar"}); !errors.As(err, &permErr) || permErr.TargetLevel != 100 {
+		t.Fatalf("KickUser: got %v, want a *PermissionError", err)
+	}
+	if _, err := cli.BanUser(ctx, "!foo:bar", &ReqBanUser{UserID: "@spammer:bar", Reason: "flood"}); !errors.As(err, &permErr) || permErr.RequiredLevel != 75 {
+		t.Fatalf("BanUser: got %v, want a *PermissionError", err)
+	}
+	if _, err := cli.BanUser(ctx, "!foo:bar", nil); err == nil {
+		t.Fatal("BanUser: expected error for a nil request, got nil")
+	}
+	cli.PrecheckPermissions = false
+	if _, err := cli.BanUser(ctx, "!foo:bar", &ReqBanUser{UserID: "@spammer:bar", Reason: "flood"}); err != nil {
+		t.Fatalf("BanUser: error, got %s", err.Error())
+	}
+
+	want := `{"reason":"spam","user_id":"@spammer:bar"}` + "\n" + `{"reason":"flood","user_id":"@spammer:bar"}`
+	if got := strings.Join(sent, "\n"); got != want {
+		t.Fatalf("KickUser/BanUser: sent\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestClient_KickPrecheckDefaults(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/state/m.room.power_levels/" {
+			// kick is omitted, so it defaults to 50.
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"users":{"@user:test.gomatrix.org":10}}`)),
+			}, nil
+		}
+		return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+	})
+	cli.PrecheckPermissions = true
+
+	var permErr *PermissionError
+	if _, err := cli.KickUser(ctx, "!foo:bar", &ReqKickUser{UserID: "@spammer:bar"}); !errors.As(err, &permErr) {
+		t.Fatalf("KickUser: got %v, want a *PermissionError", err)
+	}
+	if permErr.UserLevel != 10 || permErr.RequiredLevel != 50 || permErr.TargetLevel != 0 {
+		t.Fatalf("KickUser: got %+v", permErr)
+	}
+}
+
+func TestClient_GetAccountDataTyped(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/_matrix/client/r0/user/@user:test.gomatrix.org/account_data/com.example.settings":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"language":"en","volume":3}`))}, nil
+		case "/_matrix/client/r0/user/@user:test.gomatrix.org/account_data/com.example.unset":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Account data not found"}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	type settings struct {
+		Language string `json:"language"`
+		Volume   int    `json:"volume"`
+	}
+	var got settings
+	if err := cli.GetAccountDataTyped(ctx, "com.example.settings", &got); err != nil {
+		t.Fatalf("GetAccountDataTyped: error, got %s", err.Error())
+	}
+	if got.Language != "en" || got.Volume != 3 {
+		t.Fatalf("GetAccountDataTyped: got %+v", got)
+	}
+	unset := settings{Language: "default"}
+	if err := cli.GetAccountDataTyped(ctx, "com.example.unset", &unset); err != ErrAccountDataNotFound {
+		t.Fatalf("GetAccountDataTyped: got %v, want ErrAccountDataNotFound", err)
+	}
+	if unset.Language != "default" {
+		t.Fatalf("GetAccountDataTyped: modified out to %+v on 404", unset)
+	}
+}
+
+func TestClient_GetDevice(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/_matrix/client/r0/devices/ABCDEF":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"device_id":"ABCDEF","display_name":"web","last_seen_ts":1620644706232}`))}, nil
+		case "/_matrix/client/r0/devices/MISSING":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Not found"}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	device, err := cli.GetDevice(ctx, "ABCDEF")
+	if err != nil {
+		t.Fatalf("GetDevice: error, got %s", err.Error())
+	}
+	if device.DeviceId != "ABCDEF" || device.DisplayName != "web" {
+		t.Fatalf("GetDevice: got %+v", device)
+	}
+	if _, err = cli.GetDevice(ctx, "MISSING"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetDevice: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestClient_UploadKeys(t *testing.T) {
+	var bodies []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, strings.TrimSpace(string(b)))
+		switch {
+		case req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/keys/upload":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"one_time_key_counts":{"signed_curve25519":20}}`))}, nil
+		case req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/keys/signatures/upload":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"failures":{"@alice:bar":{"HIJKLMN":{"errcode":"M_INVALID_SIGNATURE"}}}}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	resp, err := cli.UploadKeys(ctx, &ReqUploadKeys{
+		FallbackKeys: json.RawMessage(`{"signed_curve25519:AAAAGj":{"key":"abc","fallback":true}}`),
+	})
+	if err != nil {
+		t.Fatalf("UploadKeys: error, got %s", err.Error())
+	}
+	if resp.OneTimeKeyCounts["signed_curve25519"] != 20 {
+		t.Fatalf("UploadKeys: got %+v", resp)
+	}
+	sigResp, err := cli.UploadSignatures(ctx, ReqUploadSignatures{
+		"@alice:bar": {"HIJKLMN": json.RawMessage(`{"device_id":"HIJKLMN"}`)},
+	})
+	if err != nil {
+		t.Fatalf("UploadSignatures: error, got %s", err.Error())
+	}
+	if _, ok := sigResp.Failures["@alice:bar"]["HIJKLMN"]; !ok {
+		t.Fatalf("UploadSignatures: got %+v", sigResp)
+	}
+
+	want := `{"fallback_keys":{"signed_curve25519:AAAAGj":{"key":"abc","fallback":true}}}` + "\n" + `{"@alice:bar":{"HIJKLMN":{"device_id":"HIJKLMN"}}}`
+	if got := strings.Join(bodies, "\n"); got != want {
+		t.Fatalf("UploadKeys/UploadSignatures: sent\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestClient_StrictJSON(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"user_id":"@user:test.gomatrix.org","device_id":"ABC","org.example.new_field":1}`)),
+		}, nil
+	})
+
+	if _, err := cli.WhoAmI(ctx); err != nil {
+		t.Fatalf("WhoAmI: error, got %s", err.Error())
+	}
+	cli.StrictJSON = true
+	if _, err := cli.WhoAmI(ctx); err == nil || !strings.Contains(err.Error(), "org.example.new_field") {
+		t.Fatalf("WhoAmI: got %v, want an unknown field error", err)
+	}
+}
+
+func TestClient_OnRequest(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/_matrix/client/r0/rooms/!foo:bar/leave" {
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN","error":"Not in room"}`))}, nil
+		}
+		if req.URL.Path == "/_matrix/client/r0/login" {
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"access_token":"abc","user_id":"@alice:bar"}`))}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!foo:bar"}`))}, nil
+	})
+	var logs []string
+	cli.OnRequest = func(method, url string, reqBody, respBody []byte, status int, err error) {
+		logs = append(logs, fmt.Sprintf("%s %s %q %q %d %t", method, url, reqBody, respBody, status, err != nil))
+	}
+	cli.OnRequestMaxBodyBytes = 10
+
+	if _, err := cli.JoinRoom(ctx, "!foo:bar", "", nil); err != nil {
+		t.Fatalf("JoinRoom: error, got %s", err.Error())
+	}
+	if _, err := cli.LeaveRoom(ctx, "!foo:bar"); err == nil {
+		t.Fatal("LeaveRoom: expected error, got nil")
+	}
+	if err := cli.MakeRequest(ctx, "GET", cli.BuildURLWithQuery([]string{"sync"}, map[string]string{"access_token": "secret"}), nil, nil); err != nil {
+		t.Fatalf("MakeRequest: error, got %s", err.Error())
+	}
+
+	cli.OnRequestMaxBodyBytes = -1
+	login := map[string]string{"type": "m.login.password", "user": "alice", "password": "hunter2"}
+	if err := cli.MakeRequest(ctx, "POST", cli.BuildURL("login"), login, nil); err != nil {
+		t.Fatalf("MakeRequest: error, got %s", err.Error())
+	}
+	uia := map[string]interface{}{"auth": map[string]interface{}{"type": "m.login.password", "password": "hunter2"}, "refresh_token": "r1"}
+	if err := cli.MakeRequest(ctx, "POST", cli.BuildURL("account", "deactivate"), uia, nil); err != nil {
+		t.Fatalf("MakeRequest: error, got %s", err.Error())
+	}
+
+	want := []string{
+		`POST https://test.gomatrix.org/_matrix/client/r0/join/%21foo:bar "" "{\"room_id\"" 200 false`,
+		`POST https://test.gomatrix.org/_matrix/client/r0/rooms/%21foo:bar/leave "{}\n" "{\"errcode\"" 403 true`,
+		`GET https://test.gomatrix.org/_matrix/client/r0/sync?access_token=REDACTED "" "{\"room_id\"" 200 false`,
+		`POST https://test.gomatrix.org/_matrix/client/r0/login "{\"password\":\"REDACTED\",\"type\":\"m.login.password\",\"user\":\"alice\"}" "{\"access_token\":\"REDACTED\",\"user_id\":\"@alice:bar\"}" 200 false`,
+		`POST https://test.gomatrix.org/_matrix/client/r0/account/deactivate "{\"auth\":{\"password\":\"REDACTED\",\"type\":\"m.login.password\"},\"refresh_token\":\"REDACTED\"}" "{\"room_id\":\"!foo:bar\"}" 200 false`,
+	}
+	if strings.Join(logs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("OnRequest: got\n%s\nwant\n%s", strings.Join(logs, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClient_JoinedMembersDisplayNames(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/joined_members" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{"joined":{
+				"@alice:bar":{"display_name":"Alice"},
+				"@alice:baz":{"display_name":"alice"},
+				"@bob:bar":{"display_name":"Bob","avatar_url":"mxc://bar/bob"},
+				"@carol:bar":{}
+			}}`)),
+		}, nil
+	})
+
+	resp, err := cli.JoinedMembers(ctx, "!foo:bar")
+	if err != nil {
+		t.Fatalf("JoinedMembers: error, got %s", err.Error())
+	}
+	names := resp.DisplayNames()
+	if len(names) != 3 || names["@bob:bar"] != "Bob" {
+		t.Fatalf("DisplayNames: got %v", names)
+	}
+	if got := fmt.Sprint(resp.FindByDisplayName("ALICE")); got != "[@alice:bar @alice:baz]" {
+		t.Fatalf("FindByDisplayName: got %s", got)
+	}
+	if got := resp.FindByDisplayName("carol"); len(got) != 0 {
+		t.Fatalf("FindByDisplayName: got %v, want none", got)
+	}
+	if len(resp.Joined) != 4 {
+		t.Fatalf("JoinedMembers: got %d members, want 4", len(resp.Joined))
+	}
+}
+
+func TestClient_GetDevicesSortByLastSeen(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/_matrix/client/r0/devices" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(bytes.NewBufferString(`{"devices":[
+				{"device_id":"OLD","display_name":"phone","last_seen_ip":"1.2.3.4","last_seen_ts":1000},
+				{"device_id":"NEVER"},
+				{"device_id":"NEW","display_name":"web","last_seen_ip":"5.6.7.8","last_seen_ts":3000},
+				{"device_id":"B","last_seen_ts":2000},
+				{"device_id":"A","last_seen_ts":2000}
+			]}`)),
+		}, nil
+	})
+
+	resp, err := cli.GetDevices(ctx)
+	if err != nil {
+		t.Fatalf("GetDevices: error, got %s", err.Error())
+	}
+	resp.SortByLastSeen()
+	var ids []string
+	for _, d := range resp.Devices {
+		ids = append(ids, d.DeviceId)
+	}
+	if got := strings.Join(ids, ","); got != "NEW,A,B,OLD,NEVER" {
+		t.Fatalf("SortByLastSeen: got %s, want NEW,A,B,OLD,NEVER", got)
+	}
+	if d := resp.Devices[0]; d.DisplayName != "web" || d.LastSeenIP != "5.6.7.8" || d.LastSeenTs != 3000 {
+		t.Fatalf("GetDevices: got %+v", d)
+	}
+}
+
+func TestClient_ResolveAndJoin(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/directory/room/#public:bar":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!public:bar","servers":["bar","baz"]}`))}, nil
+		case req.Method == "GET" && req.URL.Path == "/_matrix/client/r0/directory/room/#private:bar":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!private:bar","servers":["bar"]}`))}, nil
+		case req.Method == "GET":
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_NOT_FOUND","error":"Room alias not found"}`))}, nil
+		case req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/join/!public:bar":
+			if got := strings.Join(req.URL.Query()["server_name"], ","); got != "bar,baz" {
+				return nil, fmt.Errorf("unexpected server_name: %s", got)
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"room_id":"!public:bar"}`))}, nil
+		case req.Method == "POST" && req.URL.Path == "/_matrix/client/r0/join/!private:bar":
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN","error":"You are not invited to this room."}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	roomID, resp, err := cli.ResolveAndJoin(ctx, "#public:bar", nil)
+	if err != nil || roomID != "!public:bar" || resp.RoomID != "!public:bar" {
+		t.Fatalf("ResolveAndJoin: got %s, %+v, %v", roomID, resp, err)
+	}
+	roomID, _, err = cli.ResolveAndJoin(ctx, "#private:bar", []string{"bar"})
+	if roomID != "!private:bar" || !errors.Is(err, ErrForbidden) {
+		t.Fatalf("ResolveAndJoin: got %s, %v, want the room ID and ErrForbidden", roomID, err)
+	}
+	roomID, _, err = cli.ResolveAndJoin(ctx, "#missing:bar", nil)
+	if roomID != "" || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ResolveAndJoin: got %s, %v, want ErrNotFound", roomID, err)
+	}
+}
+
+func TestClient_Add3PID(t *testing.T) {
+	var bodies []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, req.URL.Path+" "+strings.TrimSpace(string(b)))
+		switch req.URL.Path {
+		case "/_matrix/client/r0/account/3pid/add":
+			if !strings.Contains(string(b), `"auth"`) {
+				return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(bytes.NewBufferString(`{"flows":[{"stages":["m.login.password"]}],"session":"xyz"}`))}, nil
+			}
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		case "/_matrix/client/r0/account/3pid/bind":
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{}`))}, nil
+		}
+		return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+	})
+
+	req := &ReqAdd3PID{ClientSecret: "secret", Sid: "sid1"}
+	uia, err := cli.Add3PID(ctx, req)
+	if err != nil || uia == nil || uia.Session != "xyz" {
+		t.Fatalf("Add3PID: got %+v, %v, want a UIA response", uia, err)
+	}
+	req.Auth = map[string]string{"type": "m.login.password", "session": uia.Session}
+	if uia, err = cli.Add3PID(ctx, req); err != nil || uia != nil {
+		t.Fatalf("Add3PID: got %+v, %v", uia, err)
+	}
+	if err = cli.Bind3PID(ctx, &ReqBind3PID{ClientSecret: "secret", IDAccessToken: "token", IDServer: "id.bar", Sid: "sid2"}); err != nil {
+		t.Fatalf("Bind3PID: error, got %s", err.Error())
+	}
+
+	want := []string{
+		`/_matrix/client/r0/account/3pid/add {"client_secret":"secret","sid":"sid1"}`,
+		`/_matrix/client/r0/account/3pid/add {"auth":{"session":"xyz","type":"m.login.password"},"client_secret":"secret","sid":"sid1"}`,
+		`/_matrix/client/r0/account/3pid/bind {"client_secret":"secret","id_access_token":"token","id_server":"id.bar","sid":"sid2"}`,
+	}
+	if strings.Join(bodies, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Add3PID/Bind3PID: sent\n%s\nwant\n%s", strings.Join(bodies, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClient_DeleteThreePID(t *testing.T) {
+	var bodies []string
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/_matrix/client/r0/account/3pid/delete" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, strings.TrimSpace(string(b)))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"id_server_unbind_result":"success"}`))}, nil
+	})
+
+	resp, err := cli.DeleteThreePID(ctx, "email", "alice@example.org", "")
+	if err != nil {
+		t.Fatalf("DeleteThreePID: error, got %s", err.Error())
+	}
+	if resp.IDServerUnbindResult != "success" {
+		t.Fatalf("DeleteThreePID: got %+v", resp)
+	}
+	if _, err = cli.DeleteThreePID(ctx, "msisdn", "447700900000", "id.bar"); err != nil {
+		t.Fatalf("DeleteThreePID: error, got %s", err.Error())
+	}
+	if _, err = cli.DeleteThreePID(ctx, "fax", "123", ""); err == nil {
+		t.Fatal("DeleteThreePID: expected error for an unknown medium, got nil")
+	}
+
+	want := []string{
+		`{"medium":"email","address":"alice@example.org"}`,
+		`{"id_server":"id.bar","medium":"msisdn","address":"447700900000"}`,
+	}
+	if strings.Join(bodies, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("DeleteThreePID: sent\n%s\nwant\n%s", strings.Join(bodies, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestClient_SubmitToken(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.String() != "https://id.bar/_matrix/identity/v2/validate/msisdn/submitToken" {
+			return nil, fmt.Errorf("unhandled request: %s %s", req.Method, req.URL)
+		}
+		var body ReqSubmitToken
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		if body != (ReqSubmitToken{Sid: "sid", ClientSecret: "secret", Token: "123456"}) {
+			return nil, fmt.Errorf("unexpected body: %+v", body)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(`{"success":true}`))}, nil
+	})
+
+	resp, err := cli.SubmitToken(ctx, "https://id.bar/_matrix/identity/v2/validate/msisdn/submitToken", ReqSubmitToken{Sid: "sid", ClientSecret: "secret", Token: "123456"})
+	if err != nil {
+		t.Fatalf("SubmitToken: error, got %s", err.Error())
+	}
+	if !resp.Success {
+		t.Fatalf("SubmitToken: got %+v", resp)
+	}
+}
+
+func TestClient_LoginWithToken(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/_matrix/client/r0/login" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		if body["type"] != "m.login.token" || body["token"] != "sso-token" || body["device_id"] != "DEV" {
+			return &http.Response{StatusCode: 403, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN","error":"Invalid login token"}`))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"access_token":"abc","device_id":"DEV","user_id":"@alice:bar"}`)),
+		}, nil
+	})
+
+	resp, err := cli.LoginWithToken(ctx, "sso-token", "DEV")
+	if err != nil {
+		t.Fatalf("LoginWithToken: error, got %s", err.Error())
+	}
+	if resp.AccessToken != "abc" || resp.UserID != "@alice:bar" {
+		t.Fatalf("LoginWithToken: got %+v", resp)
+	}
+	if cli.AccessToken != "abcdef" {
+		t.Fatalf("LoginWithToken: changed the client's access token to %s", cli.AccessToken)
+	}
+}
+
+func TestClient_LoginWithPassword(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		if req.Method != "POST" || req.URL.Path != "/_matrix/client/r0/login" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		identifier, _ := body["identifier"].(map[string]interface{})
+		if _, legacy := body["user"]; legacy || body["type"] != "m.login.password" || body["password"] != "hunter2" ||
+			identifier["type"] != "m.id.user" || identifier["user"] != "@alice:bar" {
+			return &http.Response{StatusCode: 400, Body: ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_UNKNOWN","error":"Invalid login submission"}`))}, nil
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"access_token":"abc","device_id":"NEWDEV","user_id":"@alice:bar"}`)),
+		}, nil
+	})
+
+	resp, err := cli.LoginWithPassword(ctx, "@alice:bar", "hunter2", "")
+	if err != nil {
+		t.Fatalf("LoginWithPassword: error, got %s", err.Error())
+	}
+	if resp.AccessToken != "abc" || resp.DeviceID != "NEWDEV" {
+		t.Fatalf("LoginWithPassword: got %+v", resp)
+	}
+}
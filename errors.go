@@ -0,0 +1,151 @@
+package gomatrix
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Standard error codes returned by homeservers in RespError.ErrCode.
+// See https://spec.matrix.org/v1.2/client-server-api/#standard-error-response
+const (
+	ErrCodeForbidden               = "M_FORBIDDEN"
+	ErrCodeUnknownToken            = "M_UNKNOWN_TOKEN"
+	ErrCodeMissingToken            = "M_MISSING_TOKEN"
+	ErrCodeBadJSON                 = "M_BAD_JSON"
+	ErrCodeNotJSON                 = "M_NOT_JSON"
+	ErrCodeNotFound                = "M_NOT_FOUND"
+	ErrCodeLimitExceeded           = "M_LIMIT_EXCEEDED"
+	ErrCodeUnknown                 = "M_UNKNOWN"
+	ErrCodeUnrecognized            = "M_UNRECOGNIZED"
+	ErrCodeUnauthorized            = "M_UNAUTHORIZED"
+	ErrCodeUserDeactivated         = "M_USER_DEACTIVATED"
+	ErrCodeUserInUse               = "M_USER_IN_USE"
+	ErrCodeInvalidUsername         = "M_INVALID_USERNAME"
+	ErrCodeRoomInUse               = "M_ROOM_IN_USE"
+	ErrCodeInvalidRoomState        = "M_INVALID_ROOM_STATE"
+	ErrCodeThreePIDInUse           = "M_THREEPID_IN_USE"
+	ErrCodeThreePIDNotFound        = "M_THREEPID_NOT_FOUND"
+	ErrCodeThreePIDAuthFailed      = "M_THREEPID_AUTH_FAILED"
+	ErrCodeThreePIDDenied          = "M_THREEPID_DENIED"
+	ErrCodeUnsupportedRoomVersion  = "M_UNSUPPORTED_ROOM_VERSION"
+	ErrCodeIncompatibleRoomVersion = "M_INCOMPATIBLE_ROOM_VERSION"
+	ErrCodeBadState                = "M_BAD_STATE"
+	ErrCodeGuestAccessForbidden    = "M_GUEST_ACCESS_FORBIDDEN"
+	ErrCodeMissingParam            = "M_MISSING_PARAM"
+	ErrCodeInvalidParam            = "M_INVALID_PARAM"
+	ErrCodeTooLarge                = "M_TOO_LARGE"
+	ErrCodeExclusive               = "M_EXCLUSIVE"
+	ErrCodeResourceLimitExceeded   = "M_RESOURCE_LIMIT_EXCEEDED"
+)
+
+// Sentinel errors which can be used with errors.Is to check the Matrix error code of an error returned by a Client
+// method, e.g.
+//
+//	if errors.Is(err, gomatrix.ErrForbidden) {
+//		// handle M_FORBIDDEN
+//	}
+var (
+	ErrForbidden               = RespError{ErrCode: ErrCodeForbidden}
+	ErrUnknownToken            = RespError{ErrCode: ErrCodeUnknownToken}
+	ErrMissingToken            = RespError{ErrCode: ErrCodeMissingToken}
+	ErrBadJSON                 = RespError{ErrCode: ErrCodeBadJSON}
+	ErrNotJSON                 = RespError{ErrCode: ErrCodeNotJSON}
+	ErrNotFound                = RespError{ErrCode: ErrCodeNotFound}
+	ErrLimitExceeded           = RespError{ErrCode: ErrCodeLimitExceeded}
+	ErrUnknown                 = RespError{ErrCode: ErrCodeUnknown}
+	ErrUnrecognized            = RespError{ErrCode: ErrCodeUnrecognized}
+	ErrUnauthorized            = RespError{ErrCode: ErrCodeUnauthorized}
+	ErrUserDeactivated         = RespError{ErrCode: ErrCodeUserDeactivated}
+	ErrUserInUse               = RespError{ErrCode: ErrCodeUserInUse}
+	ErrInvalidUsername         = RespError{ErrCode: ErrCodeInvalidUsername}
+	ErrRoomInUse               = RespError{ErrCode: ErrCodeRoomInUse}
+	ErrInvalidRoomState        = RespError{ErrCode: ErrCodeInvalidRoomState}
+	ErrThreePIDInUse           = RespError{ErrCode: ErrCodeThreePIDInUse}
+	ErrThreePIDNotFound        = RespError{ErrCode: ErrCodeThreePIDNotFound}
+	ErrThreePIDAuthFailed      = RespError{ErrCode: ErrCodeThreePIDAuthFailed}
+	ErrThreePIDDenied          = RespError{ErrCode: ErrCodeThreePIDDenied}
+	ErrUnsupportedRoomVersion  = RespError{ErrCode: ErrCodeUnsupportedRoomVersion}
+	ErrIncompatibleRoomVersion = RespError{ErrCode: ErrCodeIncompatibleRoomVersion}
+	ErrBadState                = RespError{ErrCode: ErrCodeBadState}
+	ErrGuestAccessForbidden    = RespError{ErrCode: ErrCodeGuestAccessForbidden}
+	ErrMissingParam            = RespError{ErrCode: ErrCodeMissingParam}
+	ErrInvalidParam            = RespError{ErrCode: ErrCodeInvalidParam}
+	ErrTooLarge                = RespError{ErrCode: ErrCodeTooLarge}
+	ErrExclusive               = RespError{ErrCode: ErrCodeExclusive}
+	ErrResourceLimitExceeded   = RespError{ErrCode: ErrCodeResourceLimitExceeded}
+)
+
+// Is reports whether target is a RespError with the same error code. Only the ErrCode is compared, so the sentinel
+// errors above match any message or retry delay.
+func (e RespError) Is(target error) bool {
+	t, ok := target.(RespError)
+	if !ok {
+		return false
+	}
+	return e.ErrCode != "" && e.ErrCode == t.ErrCode
+}
+
+// Is reports whether the Matrix error wrapped by this HTTPError matches target. This allows callers to write
+// errors.Is(err, gomatrix.ErrForbidden) on errors returned by MakeRequest.
+func (e HTTPError) Is(target error) bool {
+	return e.MatrixError.Is(target)
+}
+
+// Unwrap returns the WrappedError, so that errors.Is and errors.As can inspect e.g. a failure to read the body.
+func (e HTTPError) Unwrap() error {
+	return e.WrappedError
+}
+
+// ErrResponseTooLarge is returned when a response body is larger than Client.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("response body exceeds Client.MaxResponseBytes")
+
+// ErrAccountDataNotFound is returned by Client.GetAccountDataTyped when the account data has never been set.
+var ErrAccountDataNotFound = errors.New("account data not found")
+
+// ContentError is returned by Client.SetState when the content of an event can't be encoded as JSON. Nothing was
+// sent to the homeserver.
+type ContentError struct {
+	EventType string
+	Err       error
+}
+
+func (e *ContentError) Error() string {
+	return fmt.Sprintf("failed to encode content of %s event: %v", e.EventType, e.Err)
+}
+
+// Unwrap returns the JSON encoding error.
+func (e *ContentError) Unwrap() error {
+	return e.Err
+}
+
+// PermissionError is returned by Client.KickUser and Client.BanUser when Client.PrecheckPermissions is set and the
+// power levels of the room don't allow the action. Nothing was sent to the homeserver.
+type PermissionError struct {
+	UserID        string
+	RoomID        string
+	Action        string // "kick" or "ban"
+	Target        string
+	UserLevel     int // The power level of UserID
+	RequiredLevel int // The power level required for Action
+	TargetLevel   int // The power level of Target, which UserLevel must be higher than
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s is not allowed to %s %s in %s: has power level %d, needs at least %d and more than the target's %d",
+		e.UserID, e.Action, e.Target, e.RoomID, e.UserLevel, e.RequiredLevel, e.TargetLevel)
+}
+
+// IsMatrixError returns true if err is, or wraps, an HTTPError or RespError with the given Matrix error code.
+func IsMatrixError(err error, code string) bool {
+	if code == "" {
+		return false
+	}
+	return errors.Is(err, RespError{ErrCode: code})
+}
+
+// IsTokenExpired returns true if the homeserver rejected the access token with M_UNKNOWN_TOKEN. If
+// MatrixError.SoftLogout is also set, the client should refresh its token or log in again without
+// discarding its device.
+func (e HTTPError) IsTokenExpired() bool {
+	return e.MatrixError.ErrCode == ErrCodeUnknownToken
+}
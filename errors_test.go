@@ -0,0 +1,76 @@
+package gomatrix
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestHTTPError_Is(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 403,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_FORBIDDEN","error":"You are not invited to this room."}`)),
+		}, nil
+	})
+
+	_, err := cli.JoinRoom(ctx, "!foo:bar", "", nil)
+	if err == nil {
+		t.Fatal("JoinRoom: expected error, got nil")
+	}
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("errors.Is(err, ErrForbidden): got false, want true. err=%s", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Fatalf("errors.Is(err, ErrNotFound): got true, want false")
+	}
+	if !IsMatrixError(err, ErrCodeForbidden) {
+		t.Fatalf("IsMatrixError(err, %s): got false, want true", ErrCodeForbidden)
+	}
+	if IsMatrixError(errors.New("network error"), ErrCodeForbidden) {
+		t.Fatalf("IsMatrixError: got true for a non-Matrix error")
+	}
+}
+
+func TestHTTPError_RetryAfterHeader(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 429,
+			Header:     http.Header{"Retry-After": []string{"3"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`)),
+		}, nil
+	})
+
+	_, err := cli.SendText(ctx, "!foo:bar", "hello")
+	httpErr, ok := err.(*HTTPError)
+	if !ok {
+		t.Fatalf("SendText: expected *HTTPError, got %T", err)
+	}
+	if httpErr.MatrixError.RetryAfterMs != 3000 {
+		t.Fatalf("RetryAfterMs: got %d, want %d", httpErr.MatrixError.RetryAfterMs, 3000)
+	}
+	if httpErr.IsTokenExpired() {
+		t.Fatal("IsTokenExpired: got true for M_LIMIT_EXCEEDED")
+	}
+}
+
+func TestClient_MaxResponseBytes(t *testing.T) {
+	body := `{"joined_rooms":["!foo:bar","!baz:bar"]}`
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+
+	cli.MaxResponseBytes = int64(len(body))
+	if _, err := cli.JoinedRooms(ctx); err != nil {
+		t.Fatalf("JoinedRooms: error for a body of exactly MaxResponseBytes, got %s", err)
+	}
+	cli.MaxResponseBytes = 16
+	if _, err := cli.JoinedRooms(ctx); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("JoinedRooms: got error %v, want ErrResponseTooLarge", err)
+	}
+}
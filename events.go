@@ -1,8 +1,8 @@
 package gomatrix
 
 import (
-	"html"
-	"regexp"
+	"encoding/json"
+	"strings"
 )
 
 // Event represents a single Matrix event.
@@ -41,12 +41,192 @@ func (event *Event) MessageType() (msgtype string, ok bool) {
 	return
 }
 
+// Age returns the value of "age" in the unsigned data of the event, which is the number of milliseconds since the
+// event was sent when the homeserver returned it, if it is present and is a number.
+func (event *Event) Age() (age int64, ok bool) {
+	value, ok := event.Unsigned["age"].(float64)
+	return int64(value), ok
+}
+
+// IsRedacted returns true if the unsigned data of the event has a "redacted_because" key, meaning the event has
+// been redacted and its content has been stripped.
+func (event *Event) IsRedacted() bool {
+	_, exists := event.Unsigned["redacted_because"]
+	return exists
+}
+
+// TransactionID returns the value of "transaction_id" in the unsigned data of the event if it is present and is a
+// string. The homeserver only sets it on events sent by this client's device, so it can be used to recognize the
+// echo of an event sent with SendMessageEventWithTxn.
+func (event *Event) TransactionID() (txnID string, ok bool) {
+	txnID, ok = event.Unsigned["transaction_id"].(string)
+	return
+}
+
+// ReceiptData is the receipt of a single user for an event, see Event.Receipts.
+type ReceiptData struct {
+	TS       int64  `json:"ts"`                  // When the user read up to the event, in milliseconds since the epoch
+	ThreadID string `json:"thread_id,omitempty"` // The thread of a threaded receipt, or "main"; empty if unthreaded
+}
+
+// Receipts decodes the m.read receipts of an m.receipt ephemeral event, as passed to DefaultSyncer.OnEphemeral, into
+// a map of event IDs to the users who have read up to that event. ok is false if the event isn't an m.receipt event
+// or its content can't be decoded. Other receipt types, such as m.read.private, are ignored.
+// See https://spec.matrix.org/v1.7/client-server-api/#mreceipt
+func (event *Event) Receipts() (receipts map[string]map[string]ReceiptData, ok bool) {
+	if event.Type != "m.receipt" {
+		return nil, false
+	}
+	var content map[string]map[string]map[string]ReceiptData
+	if err := event.UnmarshalContent(&content); err != nil {
+		return nil, false
+	}
+	receipts = make(map[string]map[string]ReceiptData, len(content))
+	for eventID, byType := range content {
+		if users := byType["m.read"]; len(users) > 0 {
+			receipts[eventID] = users
+		}
+	}
+	return receipts, true
+}
+
+// UnmarshalContent decodes the event content into out, which should be a pointer to a struct such as
+// MemberEventContent or TextMessage. This avoids type asserting values out of the Content map by hand.
+func (event *Event) UnmarshalContent(out interface{}) error {
+	return remarshal(event.Content, out)
+}
+
+// UnmarshalPrevContent decodes the event prev_content into out. See UnmarshalContent.
+func (event *Event) UnmarshalPrevContent(out interface{}) error {
+	return remarshal(event.PrevContent, out)
+}
+
+// SetContent replaces the event content with the JSON encoding of in.
+func (event *Event) SetContent(in interface{}) error {
+	content := make(map[string]interface{})
+	if err := remarshal(in, &content); err != nil {
+		return err
+	}
+	event.Content = content
+	return nil
+}
+
+func remarshal(in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// asMessage decodes the content of an m.room.message event into out if its msgtype is msgtype.
+func (event *Event) asMessage(msgtype string, out interface{}) bool {
+	if event.Type != "m.room.message" {
+		return false
+	}
+	if t, _ := event.MessageType(); t != msgtype {
+		return false
+	}
+	return event.UnmarshalContent(out) == nil
+}
+
+// AsTextMessage returns the content of an m.room.message event with a msgtype of m.text. ok is false if the
+// event is not an m.text message or its content cannot be decoded.
+func (event *Event) AsTextMessage() (msg *TextMessage, ok bool) {
+	msg = &TextMessage{}
+	if !event.asMessage("m.text", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// AsNoticeMessage returns the content of an m.room.message event with a msgtype of m.notice.
+func (event *Event) AsNoticeMessage() (msg *TextMessage, ok bool) {
+	msg = &TextMessage{}
+	if !event.asMessage("m.notice", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// AsEmoteMessage returns the content of an m.room.message event with a msgtype of m.emote.
+func (event *Event) AsEmoteMessage() (msg *TextMessage, ok bool) {
+	msg = &TextMessage{}
+	if !event.asMessage("m.emote", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// AsImageMessage returns the content of an m.room.message event with a msgtype of m.image.
+func (event *Event) AsImageMessage() (msg *ImageMessage, ok bool) {
+	msg = &ImageMessage{}
+	if !event.asMessage("m.image", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// AsVideoMessage returns the content of an m.room.message event with a msgtype of m.video.
+func (event *Event) AsVideoMessage() (msg *VideoMessage, ok bool) {
+	msg = &VideoMessage{}
+	if !event.asMessage("m.video", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// AsAudioMessage returns the content of an m.room.message event with a msgtype of m.audio.
+func (event *Event) AsAudioMessage() (msg *AudioMessage, ok bool) {
+	msg = &AudioMessage{}
+	if !event.asMessage("m.audio", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// AsFileMessage returns the content of an m.room.message event with a msgtype of m.file.
+func (event *Event) AsFileMessage() (msg *FileMessage, ok bool) {
+	msg = &FileMessage{}
+	if !event.asMessage("m.file", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// AsLocationMessage returns the content of an m.room.message event with a msgtype of m.location.
+func (event *Event) AsLocationMessage() (msg *LocationMessage, ok bool) {
+	msg = &LocationMessage{}
+	if !event.asMessage("m.location", msg) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// MemberEventContent is the content of an m.room.member event - https://matrix.org/docs/spec/client_server/r0.6.1#m-room-member
+type MemberEventContent struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	IsDirect    bool   `json:"is_direct,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
 // TextMessage is the contents of a Matrix formated message event.
 type TextMessage struct {
-	MsgType       string `json:"msgtype"`
-	Body          string `json:"body"`
-	FormattedBody string `json:"formatted_body"`
-	Format        string `json:"format"`
+	MsgType       string    `json:"msgtype"`
+	Body          string    `json:"body"`
+	FormattedBody string    `json:"formatted_body"`
+	Format        string    `json:"format"`
+	Mentions      *Mentions `json:"m.mentions,omitempty"`
+}
+
+// Mentions is the m.mentions object of a message, which lists the users and rooms it intentionally pings. If a
+// message has no m.mentions, homeservers fall back to matching display names in the body, so set an empty Mentions
+// to ping no one. See https://spec.matrix.org/v1.7/client-server-api/#user-and-room-mentions
+type Mentions struct {
+	UserIDs []string `json:"user_ids,omitempty"`
+	Room    bool     `json:"room,omitempty"` // If true, the whole room is pinged, like @room
 }
 
 // ThumbnailInfo contains info about an thumbnail image - http://matrix.org/docs/spec/client_server/r0.2.0.html#m-image
@@ -80,26 +260,29 @@ type VideoInfo struct {
 
 // VideoMessage is an m.video  - http://matrix.org/docs/spec/client_server/r0.2.0.html#m-video
 type VideoMessage struct {
-	MsgType string    `json:"msgtype"`
-	Body    string    `json:"body"`
-	URL     string    `json:"url"`
-	Info    VideoInfo `json:"info"`
+	MsgType  string    `json:"msgtype"`
+	Body     string    `json:"body"`
+	URL      string    `json:"url"`
+	Info     VideoInfo `json:"info"`
+	Mentions *Mentions `json:"m.mentions,omitempty"`
 }
 
 // ImageMessage is an m.image event
 type ImageMessage struct {
-	MsgType string    `json:"msgtype"`
-	Body    string    `json:"body"`
-	URL     string    `json:"url"`
-	Info    ImageInfo `json:"info"`
+	MsgType  string    `json:"msgtype"`
+	Body     string    `json:"body"`
+	URL      string    `json:"url"`
+	Info     ImageInfo `json:"info"`
+	Mentions *Mentions `json:"m.mentions,omitempty"`
 }
 
 // An HTMLMessage is the contents of a Matrix HTML formated message event.
 type HTMLMessage struct {
-	Body          string `json:"body"`
-	MsgType       string `json:"msgtype"`
-	Format        string `json:"format"`
-	FormattedBody string `json:"formatted_body"`
+	Body          string    `json:"body"`
+	MsgType       string    `json:"msgtype"`
+	Format        string    `json:"format"`
+	FormattedBody string    `json:"formatted_body"`
+	Mentions      *Mentions `json:"m.mentions,omitempty"`
 }
 
 // FileInfo contains info about an file - http://matrix.org/docs/spec/client_server/r0.2.0.html#m-file
@@ -117,6 +300,7 @@ type FileMessage struct {
 	Info          FileInfo  `json:"info,omitempty"`
 	ThumbnailURL  string    `json:"thumbnail_url,omitempty"`
 	ThumbnailInfo ImageInfo `json:"thumbnail_info,omitempty"`
+	Mentions      *Mentions `json:"m.mentions,omitempty"`
 }
 
 // LocationMessage is an m.location event - http://matrix.org/docs/spec/client_server/r0.2.0.html#m-location
@@ -126,6 +310,7 @@ type LocationMessage struct {
 	GeoURI        string    `json:"geo_uri"`
 	ThumbnailURL  string    `json:"thumbnail_url,omitempty"`
 	ThumbnailInfo ImageInfo `json:"thumbnail_info,omitempty"`
+	Mentions      *Mentions `json:"m.mentions,omitempty"`
 }
 
 // AudioInfo contains info about an file - http://matrix.org/docs/spec/client_server/r0.2.0.html#m-audio
@@ -137,10 +322,11 @@ type AudioInfo struct {
 
 // AudioMessage is an m.audio event - http://matrix.org/docs/spec/client_server/r0.2.0.html#m-audio
 type AudioMessage struct {
-	MsgType string    `json:"msgtype"`
-	Body    string    `json:"body"`
-	URL     string    `json:"url"`
-	Info    AudioInfo `json:"info,omitempty"`
+	MsgType  string    `json:"msgtype"`
+	Body     string    `json:"body"`
+	URL      string    `json:"url"`
+	Info     AudioInfo `json:"info,omitempty"`
+	Mentions *Mentions `json:"m.mentions,omitempty"`
 }
 
 // PowerLevels is and m.room.power_levels event - https://matrix.org/docs/spec/client_server/r0.6.1#m-room-power-levels
@@ -157,6 +343,209 @@ type PowerLevels struct {
 	UsersDefault  int                     `json:"users_default"`
 }
 
+// UnmarshalJSON decodes an m.room.power_levels event, applying the spec defaults to omitted keys: 50 for ban, kick,
+// redact, state_default and notifications.room, and 0 for the rest. invite defaults to 0 as in spec v1.1 and later,
+// where r0 used 50.
+func (pl *PowerLevels) UnmarshalJSON(data []byte) error {
+	type powerLevels PowerLevels // avoids recursing into this method
+	levels := powerLevels{
+		Ban:           50,
+		Kick:          50,
+		Redact:        50,
+		StateDefault:  50,
+		Notifications: NotificationPowerLevels{Room: 50},
+	}
+	if err := json.Unmarshal(data, &levels); err != nil {
+		return err
+	}
+	*pl = PowerLevels(levels)
+	return nil
+}
+
+// GetUserLevel returns the power level of userID, falling back to UsersDefault if the user is not listed.
+func (pl *PowerLevels) GetUserLevel(userID string) int {
+	if level, ok := pl.Users[userID]; ok {
+		return level
+	}
+	return pl.UsersDefault
+}
+
+// GetEventLevel returns the power level required to send eventType, falling back to StateDefault for state events
+// and EventsDefault for other events if the type is not listed.
+func (pl *PowerLevels) GetEventLevel(eventType string, state bool) int {
+	if level, ok := pl.Events[eventType]; ok {
+		return level
+	}
+	if state {
+		return pl.StateDefault
+	}
+	return pl.EventsDefault
+}
+
+// CanInvite returns true if userID is allowed to invite users to the room.
+func (pl *PowerLevels) CanInvite(userID string) bool {
+	return pl.GetUserLevel(userID) >= pl.Invite
+}
+
+// CanKick returns true if userID is allowed to kick users from the room. Kicking additionally requires a higher
+// power level than the target user, see CanKickUser.
+func (pl *PowerLevels) CanKick(userID string) bool {
+	return pl.GetUserLevel(userID) >= pl.Kick
+}
+
+// CanKickUser returns true if userID is allowed to kick target from the room.
+func (pl *PowerLevels) CanKickUser(userID, target string) bool {
+	return pl.CanKick(userID) && pl.GetUserLevel(userID) > pl.GetUserLevel(target)
+}
+
+// CanBan returns true if userID is allowed to ban users from the room. Banning additionally requires a higher
+// power level than the target user, see CanBanUser.
+func (pl *PowerLevels) CanBan(userID string) bool {
+	return pl.GetUserLevel(userID) >= pl.Ban
+}
+
+// CanBanUser returns true if userID is allowed to ban target from the room.
+func (pl *PowerLevels) CanBanUser(userID, target string) bool {
+	return pl.CanBan(userID) && pl.GetUserLevel(userID) > pl.GetUserLevel(target)
+}
+
+// CanRedact returns true if userID is allowed to redact events sent by other users.
+func (pl *PowerLevels) CanRedact(userID string) bool {
+	return pl.GetUserLevel(userID) >= pl.Redact
+}
+
+// CanSendEvent returns true if userID is allowed to send an event of type eventType. state must be true for state
+// events, which default to StateDefault rather than EventsDefault.
+func (pl *PowerLevels) CanSendEvent(userID, eventType string, state bool) bool {
+	return pl.GetUserLevel(userID) >= pl.GetEventLevel(eventType, state)
+}
+
+// Join rules for m.room.join_rules - https://spec.matrix.org/v1.3/client-server-api/#mroomjoin_rules
+const (
+	JoinRulePublic          = "public"
+	JoinRuleInvite          = "invite"
+	JoinRuleKnock           = "knock"
+	JoinRuleRestricted      = "restricted"
+	JoinRuleKnockRestricted = "knock_restricted"
+)
+
+// JoinRulesEventContent is the content of an m.room.join_rules event - https://spec.matrix.org/v1.3/client-server-api/#mroomjoin_rules
+type JoinRulesEventContent struct {
+	JoinRule string           `json:"join_rule"`
+	Allow    []AllowCondition `json:"allow,omitempty"` // Only used by the restricted and knock_restricted join rules
+}
+
+// AllowCondition is a condition under which a user may join a restricted room.
+type AllowCondition struct {
+	Type   string `json:"type"` // Currently only "m.room_membership"
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// NewRoomMembershipAllowCondition returns an AllowCondition which lets members of roomID join.
+func NewRoomMembershipAllowCondition(roomID string) AllowCondition {
+	return AllowCondition{
+		Type:   "m.room_membership",
+		RoomID: roomID,
+	}
+}
+
+// SpaceChildEventContent is the content of an m.space.child event - https://spec.matrix.org/v1.3/client-server-api/#mspacechild
+type SpaceChildEventContent struct {
+	Via       []string `json:"via"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+}
+
+// SpaceParentEventContent is the content of an m.space.parent event - https://spec.matrix.org/v1.3/client-server-api/#mspaceparent
+type SpaceParentEventContent struct {
+	Via       []string `json:"via"`
+	Canonical bool     `json:"canonical,omitempty"`
+}
+
+// CreateEventContent represents the content of an m.room.create state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-create
+type CreateEventContent struct {
+	Creator     string        `json:"creator,omitempty"`
+	RoomVersion string        `json:"room_version,omitempty"`
+	Federate    *bool         `json:"m.federate,omitempty"`
+	Predecessor *PreviousRoom `json:"predecessor,omitempty"`
+	Type        string        `json:"type,omitempty"` // The room type, e.g. "m.space".
+}
+
+// PreviousRoom is the room which a room was upgraded from.
+type PreviousRoom struct {
+	RoomID  string `json:"room_id"`
+	EventID string `json:"event_id"`
+}
+
+// AlgorithmMegolmV1 is the encryption algorithm used for rooms. See EnableEncryption.
+const AlgorithmMegolmV1 = "m.megolm.v1.aes-sha2"
+
+// EncryptionEventContent represents the content of an m.room.encryption state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-encryption
+type EncryptionEventContent struct {
+	Algorithm          string `json:"algorithm"`
+	RotationPeriodMs   int64  `json:"rotation_period_ms,omitempty"`
+	RotationPeriodMsgs int    `json:"rotation_period_msgs,omitempty"`
+}
+
+// Values of GuestAccessEventContent.GuestAccess.
+const (
+	GuestAccessCanJoin   = "can_join"
+	GuestAccessForbidden = "forbidden"
+)
+
+// GuestAccessEventContent represents the content of an m.room.guest_access state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-guest-access
+type GuestAccessEventContent struct {
+	GuestAccess string `json:"guest_access"`
+}
+
+// CanonicalAliasEventContent represents the content of an m.room.canonical_alias state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-canonical-alias
+type CanonicalAliasEventContent struct {
+	Alias      string   `json:"alias,omitempty"`
+	AltAliases []string `json:"alt_aliases,omitempty"`
+}
+
+// PinnedEventsEventContent represents the content of an m.room.pinned_events state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-pinned-events
+type PinnedEventsEventContent struct {
+	Pinned []string `json:"pinned"`
+}
+
+// TombstoneEventContent represents the content of an m.room.tombstone state event, which is sent when a room is
+// upgraded. See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-tombstone
+type TombstoneEventContent struct {
+	Body            string `json:"body"`
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// NameEventContent represents the content of an m.room.name state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-name
+type NameEventContent struct {
+	Name string `json:"name"`
+}
+
+// TopicEventContent represents the content of an m.room.topic state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-topic
+type TopicEventContent struct {
+	Topic string `json:"topic"`
+}
+
+// RoomAvatarEventContent represents the content of an m.room.avatar state event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-avatar
+type RoomAvatarEventContent struct {
+	URL  string     `json:"url"`
+	Info *ImageInfo `json:"info,omitempty"`
+}
+
+// IgnoredUserListEventContent represents the content of an m.ignored_user_list account data event.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-ignored-user-list
+type IgnoredUserListEventContent struct {
+	IgnoredUsers map[string]struct{} `json:"ignored_users"`
+}
+
 type NotificationPowerLevels struct {
 	Room int `json:"room"`
 }
@@ -212,6 +601,46 @@ const (
 	RelThread     RelationType = "m.thread"
 )
 
+// RelatesTo represents the m.relates_to object in the content of an event which relates to another event, such as
+// an edit, a reaction, a thread message or a reply.
+// See https://spec.matrix.org/v1.7/client-server-api/#forming-relationships-between-events
+type RelatesTo struct {
+	Type    RelationType `json:"rel_type,omitempty"`
+	EventID string       `json:"event_id,omitempty"`
+	Key     string       `json:"key,omitempty"` // The reaction key of an m.annotation
+	// Set on replies, which are not a rel_type, and on thread messages as a fallback for clients without threads.
+	InReplyTo *InReplyTo `json:"m.in_reply_to,omitempty"`
+	// Set on thread messages which aren't a reply, when InReplyTo is only a fallback pointing at the previous message.
+	IsFallingBack bool `json:"is_falling_back,omitempty"`
+}
+
+// InReplyTo represents the m.in_reply_to object of a reply.
+type InReplyTo struct {
+	EventID string `json:"event_id"`
+}
+
+// ReplyTo returns the ID of the event this is a reply to, or "" if it isn't a reply. The fallback m.in_reply_to of
+// a thread message which isn't a reply is ignored.
+func (r *RelatesTo) ReplyTo() string {
+	if r.InReplyTo == nil || (r.Type == RelThread && r.IsFallingBack) {
+		return ""
+	}
+	return r.InReplyTo.EventID
+}
+
+// RelatesTo decodes the m.relates_to object in the event content. ok is false if the content has no m.relates_to
+// object or it can't be decoded.
+func (event *Event) RelatesTo() (relatesTo *RelatesTo, ok bool) {
+	value, ok := event.Content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if err := remarshal(value, &relatesTo); err != nil {
+		return nil, false
+	}
+	return relatesTo, true
+}
+
 // any is an alias for interface{} and is equivalent to interface{} in all ways.
 type any = interface{}
 
@@ -233,13 +662,29 @@ type PushCondition struct {
 	RelType RelationType `json:"rel_type,omitempty"`
 }
 
-var htmlRegex = regexp.MustCompile("<[^<]+?>")
+// StripReplyFallback removes the quoted original message from the body of a reply, i.e. the leading lines starting
+// with "> " and the blank line following them. See StripReplyFallbackHTML for the formatted_body.
+// See https://spec.matrix.org/v1.7/client-server-api/#fallbacks-for-rich-replies
+func StripReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && (strings.HasPrefix(lines[i], "> ") || lines[i] == ">") {
+		i++
+	}
+	if i == 0 {
+		return body
+	}
+	if i < len(lines) && lines[i] == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
 
 // GetHTMLMessage returns an HTMLMessage with the body set to a stripped version of the provided HTML, in addition
-// to the provided HTML.
+// to the provided HTML. See HTMLToText.
 func GetHTMLMessage(msgtype, htmlText string) HTMLMessage {
 	return HTMLMessage{
-		Body:          html.UnescapeString(htmlRegex.ReplaceAllLiteralString(htmlText, "")),
+		Body:          HTMLToText(htmlText),
 		MsgType:       msgtype,
 		Format:        "org.matrix.custom.html",
 		FormattedBody: htmlText,
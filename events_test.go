@@ -91,11 +91,101 @@ func TestEventWithoutMessageType(t *testing.T) {
 	}
 }
 
+func TestEventUnsigned(t *testing.T) {
+	var e Event
+	if err := json.Unmarshal([]byte(testEvents["withFields"]), &e); err != nil {
+		t.Fatalf("TestEventUnsigned: Something went wrong while parsing: %s", err)
+	}
+	if age, ok := e.Age(); !ok || age != 1234 {
+		t.Fatalf("Age: got %d, %t, want 1234", age, ok)
+	}
+	if e.IsRedacted() {
+		t.Fatal("IsRedacted: got true for an event which isn't redacted")
+	}
+	if _, ok := e.TransactionID(); ok {
+		t.Fatal("TransactionID: got ok for an event without a transaction ID")
+	}
+
+	e = Event{}
+	err := json.Unmarshal([]byte(`{"type":"m.room.message","content":{},"unsigned":{"transaction_id":"go123","redacted_because":{"type":"m.room.redaction"}}}`), &e)
+	if err != nil {
+		t.Fatalf("TestEventUnsigned: Something went wrong while parsing: %s", err)
+	}
+	if _, ok := e.Age(); ok {
+		t.Fatal("Age: got ok for an event without an age")
+	}
+	if !e.IsRedacted() {
+		t.Fatal("IsRedacted: got false for a redacted event")
+	}
+	if txnID, ok := e.TransactionID(); !ok || txnID != "go123" {
+		t.Fatalf("TransactionID: got %s, %t, want go123", txnID, ok)
+	}
+}
+
+func TestEventRelatesTo(t *testing.T) {
+	tests := []struct {
+		content string
+		ok      bool
+		relType RelationType
+		eventID string
+		key     string
+		replyTo string
+	}{
+		{`{"body":"hi"}`, false, "", "", "", ""},
+		{`{"m.relates_to":"$abc"}`, false, "", "", "", ""},
+		{`{"m.relates_to":{"rel_type":"m.annotation","event_id":"$abc","key":"👍"}}`, true, RelAnnotation, "$abc", "👍", ""},
+		{`{"m.relates_to":{"m.in_reply_to":{"event_id":"$abc"}}}`, true, "", "", "", "$abc"},
+		{`{"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$prev"}}}`, true, RelThread, "$root", "", ""},
+		{`{"m.relates_to":{"rel_type":"m.thread","event_id":"$root","m.in_reply_to":{"event_id":"$prev"}}}`, true, RelThread, "$root", "", "$prev"},
+	}
+	for _, tt := range tests {
+		var e Event
+		if err := json.Unmarshal([]byte(`{"type":"m.room.message","content":`+tt.content+`}`), &e); err != nil {
+			t.Fatalf("TestEventRelatesTo: Something went wrong while parsing: %s", err)
+		}
+		rel, ok := e.RelatesTo()
+		if ok != tt.ok {
+			t.Fatalf("RelatesTo(%s): got ok=%t, want %t", tt.content, ok, tt.ok)
+		}
+		if !ok {
+			continue
+		}
+		if rel.Type != tt.relType || rel.EventID != tt.eventID || rel.Key != tt.key || rel.ReplyTo() != tt.replyTo {
+			t.Fatalf("RelatesTo(%s): got %+v, reply to %q", tt.content, rel, rel.ReplyTo())
+		}
+	}
+}
+
+func TestEventReceipts(t *testing.T) {
+	var e Event
+	err := json.Unmarshal([]byte(`{"type":"m.receipt","content":{
+		"$1":{"m.read":{"@alice:bar":{"ts":1000},"@bob:bar":{"ts":2000,"thread_id":"main"}}},
+		"$2":{"m.read.private":{"@carol:bar":{"ts":3000}}}
+	}}`), &e)
+	if err != nil {
+		t.Fatalf("TestEventReceipts: Something went wrong while parsing: %s", err)
+	}
+	receipts, ok := e.Receipts()
+	if !ok {
+		t.Fatal("Receipts: got ok=false for an m.receipt event")
+	}
+	if len(receipts) != 1 || len(receipts["$1"]) != 2 {
+		t.Fatalf("Receipts: got %+v", receipts)
+	}
+	if r := receipts["$1"]["@bob:bar"]; r.TS != 2000 || r.ThreadID != "main" {
+		t.Fatalf("Receipts: got %+v for @bob:bar", r)
+	}
+	e.Type = "m.typing"
+	if _, ok := e.Receipts(); ok {
+		t.Fatal("Receipts: got ok=true for an m.typing event")
+	}
+}
+
 var testHTML = `<div>a<h1>bc</h1>d<p>e<i>fg</i>hi</p>j<p>k<br/>l<b>m</b>no</p>p<small>q</small>rs</div>`
 
 func TestGetHTMLMessage(t *testing.T) {
 	msg := GetHTMLMessage("m.text", testHTML)
-	if expected := "abcdefghijklmnopqrs"; msg.Body != expected {
+	if expected := "abcd\nefghi\nj\nk\nlmno\npqrs"; msg.Body != expected {
 		t.Fatalf("TestGetHTMLMessage: got '%s', expected '%s'", msg.Body, expected)
 	}
 	if msg.FormattedBody != testHTML {
@@ -108,3 +198,117 @@ func TestGetHTMLMessage(t *testing.T) {
 		t.Fatalf("TestGetHTMLMessage: got '%s', expected '%s'", msg.Format, expected)
 	}
 }
+
+func TestEventUnmarshalContent(t *testing.T) {
+	var e Event
+	err := json.NewDecoder(strings.NewReader(testEvents["withoutFields"])).Decode(&e)
+	if err != nil {
+		t.Fatalf("TestEventUnmarshalContent: Something went wrong while parsing: %s", testEvents["withoutFields"])
+	}
+	var content MemberEventContent
+	if err := e.UnmarshalContent(&content); err != nil {
+		t.Fatalf("TestEventUnmarshalContent: UnmarshalContent failed: %s", err)
+	}
+	if content.Membership != "join" {
+		t.Fatalf("TestEventUnmarshalContent: got membership '%s', expected 'join'", content.Membership)
+	}
+	if content.DisplayName != "Alice Margatroid" {
+		t.Fatalf("TestEventUnmarshalContent: got displayname '%s', expected 'Alice Margatroid'", content.DisplayName)
+	}
+	if content.AvatarURL != "mxc://example.org/SEsfnsuifSDFSSEF" {
+		t.Fatalf("TestEventUnmarshalContent: got avatar_url '%s', expected 'mxc://example.org/SEsfnsuifSDFSSEF'", content.AvatarURL)
+	}
+
+	content.Membership = "leave"
+	if err := e.SetContent(content); err != nil {
+		t.Fatalf("TestEventUnmarshalContent: SetContent failed: %s", err)
+	}
+	if e.Content["membership"] != "leave" {
+		t.Fatalf("TestEventUnmarshalContent: got membership '%v' after SetContent, expected 'leave'", e.Content["membership"])
+	}
+}
+
+func TestEventAsTextMessage(t *testing.T) {
+	var e Event
+	err := json.NewDecoder(strings.NewReader(testEvents["withFields"])).Decode(&e)
+	if err != nil {
+		t.Fatalf("TestEventAsTextMessage: Something went wrong while parsing: %s", testEvents["withFields"])
+	}
+	msg, ok := e.AsTextMessage()
+	if !ok {
+		t.Fatal("TestEventAsTextMessage: AsTextMessage returned ok=false for an m.text event")
+	}
+	if msg.Body != "eventbody123" || msg.Format != "org.matrix.custom.html" {
+		t.Fatalf("TestEventAsTextMessage: got %+v", msg)
+	}
+	if _, ok := e.AsImageMessage(); ok {
+		t.Fatal("TestEventAsTextMessage: AsImageMessage returned ok=true for an m.text event")
+	}
+}
+
+func TestPowerLevels(t *testing.T) {
+	pl := PowerLevels{
+		Ban:           50,
+		Invite:        0,
+		Kick:          50,
+		Redact:        50,
+		Events:        map[string]int{"m.room.name": 50, "m.reaction": 10},
+		Users:         map[string]int{"@admin:bar": 100, "@mod:bar": 50},
+		EventsDefault: 0,
+		StateDefault:  50,
+		UsersDefault:  0,
+	}
+	if !pl.CanInvite("@nobody:bar") {
+		t.Fatal("TestPowerLevels: expected default user to be able to invite")
+	}
+	if pl.CanKick("@nobody:bar") || !pl.CanKick("@mod:bar") {
+		t.Fatal("TestPowerLevels: unexpected CanKick result")
+	}
+	if !pl.CanBanUser("@admin:bar", "@mod:bar") || pl.CanBanUser("@mod:bar", "@admin:bar") {
+		t.Fatal("TestPowerLevels: unexpected CanBanUser result")
+	}
+	if !pl.CanSendEvent("@nobody:bar", "m.room.message", false) {
+		t.Fatal("TestPowerLevels: expected default user to be able to send messages")
+	}
+	if pl.CanSendEvent("@nobody:bar", "m.reaction", false) {
+		t.Fatal("TestPowerLevels: expected m.reaction to require power level 10")
+	}
+	if pl.CanSendEvent("@nobody:bar", "m.room.topic", true) || !pl.CanSendEvent("@mod:bar", "m.room.topic", true) {
+		t.Fatal("TestPowerLevels: expected state events to fall back to state_default")
+	}
+}
+
+func TestPowerLevelsDefaults(t *testing.T) {
+	var pl PowerLevels
+	if err := json.Unmarshal([]byte(`{"users":{"@admin:bar":100},"kick":0}`), &pl); err != nil {
+		t.Fatalf("TestPowerLevelsDefaults: error, got %s", err)
+	}
+	if pl.Ban != 50 || pl.Redact != 50 || pl.StateDefault != 50 || pl.Notifications.Room != 50 {
+		t.Fatalf("TestPowerLevelsDefaults: omitted keys not defaulted to 50: %+v", pl)
+	}
+	if pl.Kick != 0 || pl.Invite != 0 || pl.EventsDefault != 0 || pl.UsersDefault != 0 {
+		t.Fatalf("TestPowerLevelsDefaults: unexpected levels: %+v", pl)
+	}
+	if pl.CanBan("@nobody:bar") || !pl.CanBan("@admin:bar") {
+		t.Fatal("TestPowerLevelsDefaults: expected ban to require the default of 50")
+	}
+	if pl.CanSendEvent("@nobody:bar", "m.room.topic", true) || !pl.CanSendEvent("@nobody:bar", "m.room.message", false) {
+		t.Fatal("TestPowerLevelsDefaults: unexpected CanSendEvent result")
+	}
+	if !pl.CanKick("@nobody:bar") {
+		t.Fatal("TestPowerLevelsDefaults: expected an explicit kick level of 0 to be kept")
+	}
+}
+
+func TestStripReplyFallback(t *testing.T) {
+	tests := map[string]string{
+		"> <@alice:bar> line 1\n> line 2\n>\n> line 4\n\nMy answer\n> not a fallback": "My answer\n> not a fallback",
+		"> <@alice:bar> quoted\nno blank line":                                        "no blank line",
+		"Plain message\n\nwith paragraphs":                                            "Plain message\n\nwith paragraphs",
+	}
+	for in, want := range tests {
+		if got := StripReplyFallback(in); got != want {
+			t.Errorf("StripReplyFallback(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package gomatrix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Formats supported by ExportRoom.
+const (
+	// ExportFormatJSONLines writes each event as a JSON object on its own line.
+	ExportFormatJSONLines = "jsonl"
+	// ExportFormatText writes a line of the form "<timestamp> <sender>: <body>" for each event which has a body.
+	ExportFormatText = "text"
+)
+
+// ExportOptions holds the optional parameters of ExportRoom.
+type ExportOptions struct {
+	// The pagination token to start exporting from, e.g. the token last passed to OnProgress, to resume an export.
+	// If empty, the export starts from the most recent event, see Messages.
+	From string
+	// The number of events requested per page. If 0, the homeserver's default is used.
+	PageSize int
+	// The number of times a page is retried after an M_LIMIT_EXCEEDED error. If 0, it is retried up to 5 times.
+	MaxRetries int
+	// If set, called after each page has been written with the total number of events exported so far and the
+	// token to pass as From to resume after this page. nextToken is never empty: once the start of the room has
+	// been reached, it is the last token returned by the homeserver.
+	OnProgress func(exported int, nextToken string)
+}
+
+// ExportRoom writes the history of a room to w, paging backwards with Messages until the start of the room is
+// reached, so events are written newest first. format is ExportFormatJSONLines or ExportFormatText, or empty for
+// ExportFormatJSONLines. opts may be nil.
+//
+// Rate limited requests are retried after the delay requested by the homeserver, or with an exponential backoff
+// between DefaultBackoffBase and DefaultBackoffMax if it didn't ask for one. Any other error stops the export; the
+// events written so far are not rolled back, and the export can be resumed from the last token passed to OnProgress.
+func (cli *Client) ExportRoom(ctx context.Context, roomID string, w io.Writer, format string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	var write func(*Event) error
+	switch format {
+	case "", ExportFormatJSONLines:
+		enc := json.NewEncoder(w)
+		write = func(event *Event) error {
+			return enc.Encode(event)
+		}
+	case ExportFormatText:
+		write = func(event *Event) error {
+			body, ok := event.Body()
+			if !ok {
+				return nil
+			}
+			ts := time.Unix(0, event.Timestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+			_, err := fmt.Fprintf(w, "%s %s: %s\n", ts, event.Sender, body)
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid export format %q: must be %q or %q", format, ExportFormatJSONLines, ExportFormatText)
+	}
+	maxRetries := opts.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 5
+	}
+
+	from := opts.From
+	exported := 0
+	lastToken := from
+	for {
+		resp, err := cli.messagesWithRetry(ctx, roomID, from, opts.PageSize, maxRetries)
+		if err != nil {
+			return err
+		}
+		for i := range resp.Chunk {
+			if resp.Chunk[i].RoomID == "" {
+				resp.Chunk[i].RoomID = roomID
+			}
+			if err = write(&resp.Chunk[i]); err != nil {
+				return err
+			}
+		}
+		exported += len(resp.Chunk)
+		if resp.End != "" {
+			lastToken = resp.End
+		} else if lastToken == "" {
+			lastToken = resp.Start
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(exported, lastToken)
+		}
+		if len(resp.Chunk) == 0 || resp.End == "" || resp.End == from {
+			return nil
+		}
+		from = resp.End
+	}
+}
+
+// messagesWithRetry requests a page of Messages backwards from from, retrying up to maxRetries times if the
+// request is rate limited.
+func (cli *Client) messagesWithRetry(ctx context.Context, roomID, from string, limit, maxRetries int) (resp *RespMessages, err error) {
+	backoff := DefaultBackoffBase
+	err = retryRateLimited(ctx, maxRetries, func() time.Duration {
+		wait := backoff
+		if backoff *= 2; backoff > DefaultBackoffMax {
+			backoff = DefaultBackoffMax
+		}
+		return wait
+	}, func() (err error) {
+		resp, err = cli.Messages(ctx, roomID, from, "", DirBackward, limit)
+		return
+	})
+	return
+}
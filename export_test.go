@@ -0,0 +1,92 @@
+package gomatrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClient_ExportRoom(t *testing.T) {
+	pages := map[string]string{
+		"":   `{"start":"t1","end":"t2","chunk":[{"type":"m.room.message","event_id":"$3","sender":"@alice:bar","origin_server_ts":1000,"content":{"body":"three"}}]}`,
+		"t2": `{"start":"t2","end":"t3","chunk":[{"type":"m.room.topic","event_id":"$2","state_key":"","content":{"topic":"t"}},{"type":"m.room.message","event_id":"$1","sender":"@bob:bar","origin_server_ts":0,"content":{"body":"one"}}]}`,
+		"t3": `{"start":"t3","chunk":[]}`,
+	}
+	limited := true
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		q := req.URL.Query()
+		if req.URL.Path != "/_matrix/client/r0/rooms/!foo:bar/messages" || q.Get("dir") != "b" {
+			return nil, fmt.Errorf("unhandled request: %s", req.URL)
+		}
+		page, ok := pages[q.Get("from")]
+		if !ok {
+			return nil, fmt.Errorf("unexpected from: %s", q.Get("from"))
+		}
+		if q.Get("from") == "t2" && limited {
+			limited = false
+			return &http.Response{
+				StatusCode: 429,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":1}`)),
+			}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewBufferString(page))}, nil
+	})
+
+	var buf bytes.Buffer
+	var progress []string
+	err := cli.ExportRoom(ctx, "!foo:bar", &buf, ExportFormatJSONLines, &ExportOptions{
+		OnProgress: func(exported int, nextToken string) {
+			progress = append(progress, fmt.Sprintf("%d:%s", exported, nextToken))
+		},
+	})
+	if err != nil {
+		t.Fatalf("ExportRoom: error, got %s", err.Error())
+	}
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("ExportRoom: invalid line %q: %s", line, err)
+		}
+		if event.RoomID != "!foo:bar" {
+			t.Fatalf("ExportRoom: got room ID %q, want !foo:bar", event.RoomID)
+		}
+		ids = append(ids, event.ID)
+	}
+	if got := strings.Join(ids, ","); got != "$3,$2,$1" {
+		t.Fatalf("ExportRoom: exported %s, want $3,$2,$1", got)
+	}
+	if got := strings.Join(progress, ","); got != "1:t2,3:t3,3:t3" {
+		t.Fatalf("OnProgress: got %s", got)
+	}
+
+	buf.Reset()
+	if err = cli.ExportRoom(ctx, "!foo:bar", &buf, ExportFormatText, &ExportOptions{From: "t2"}); err != nil {
+		t.Fatalf("ExportRoom: error, got %s", err.Error())
+	}
+	if got, want := buf.String(), "1970-01-01T00:00:00Z @bob:bar: one\n"; got != want {
+		t.Fatalf("ExportRoom: got %q, want %q", got, want)
+	}
+
+	// A room which fits in one page reports the start token of the page.
+	pages[""] = `{"start":"t1","chunk":[{"type":"m.room.message","event_id":"$1","content":{"body":"one"}}]}`
+	progress = nil
+	if err = cli.ExportRoom(ctx, "!foo:bar", ioutil.Discard, "", &ExportOptions{
+		OnProgress: func(exported int, nextToken string) {
+			progress = append(progress, fmt.Sprintf("%d:%s", exported, nextToken))
+		},
+	}); err != nil {
+		t.Fatalf("ExportRoom: error, got %s", err.Error())
+	}
+	if got := strings.Join(progress, ","); got != "1:t1" {
+		t.Fatalf("OnProgress: got %s", got)
+	}
+
+	if err = cli.ExportRoom(ctx, "!foo:bar", &buf, "csv", nil); err == nil {
+		t.Fatal("ExportRoom: expected error for unknown format, got nil")
+	}
+}
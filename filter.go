@@ -47,11 +47,17 @@ type FilterPart struct {
 	Senders     []string `json:"senders,omitempty"`
 	Types       []string `json:"types,omitempty"`
 	ContainsURL *bool    `json:"contains_url,omitempty"`
+
+	// Only used for the State and Timeline filters of a RoomFilter.
+	// See https://matrix.org/docs/spec/client_server/r0.6.1#lazy-loading-room-members
+	LazyLoadMembers         bool `json:"lazy_load_members,omitempty"`
+	IncludeRedundantMembers bool `json:"include_redundant_members,omitempty"`
 }
 
-// Validate checks if the filter contains valid property values
+// Validate checks if the filter contains valid property values. An empty event_format is
+// valid and means the server default of "client".
 func (filter *Filter) Validate() error {
-	if filter.EventFormat != "client" && filter.EventFormat != "federation" {
+	if filter.EventFormat != "" && filter.EventFormat != "client" && filter.EventFormat != "federation" {
 		return errors.New("bad event_format value: must be one of [client, federation]")
 	}
 	return nil
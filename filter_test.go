@@ -0,0 +1,38 @@
+package gomatrix
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFilterJSON(t *testing.T) {
+	filter := Filter{
+		Room: RoomFilter{
+			State:    FilterPart{LazyLoadMembers: true},
+			Timeline: FilterPart{Limit: 10, Types: []string{"m.room.message"}},
+		},
+	}
+	if err := filter.Validate(); err != nil {
+		t.Fatalf("TestFilterJSON: Validate failed: %s", err)
+	}
+	b, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatalf("TestFilterJSON: Marshal failed: %s", err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatalf("TestFilterJSON: Unmarshal failed: %s", err)
+	}
+	room := out["room"].(map[string]interface{})
+	if room["state"].(map[string]interface{})["lazy_load_members"] != true {
+		t.Fatalf("TestFilterJSON: lazy_load_members not set in %s", b)
+	}
+	if room["timeline"].(map[string]interface{})["limit"] != float64(10) {
+		t.Fatalf("TestFilterJSON: timeline limit not set in %s", b)
+	}
+
+	filter.EventFormat = "xml"
+	if err := filter.Validate(); err == nil {
+		t.Fatal("TestFilterJSON: expected Validate to reject event_format xml")
+	}
+}
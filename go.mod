@@ -1,3 +1,5 @@
 module github.com/globekeeper/gomatrix
 
-go 1.17
+go 1.23.0
+
+require golang.org/x/net v0.38.0
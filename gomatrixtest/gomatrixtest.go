@@ -0,0 +1,80 @@
+// Package gomatrixtest provides helpers for unit testing code built on gomatrix, in the style of net/http/httptest.
+//
+//	cli := gomatrixtest.NewTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//		gomatrixtest.WriteJSON(w, http.StatusOK, map[string]string{"event_id": "$abc"})
+//	}))
+//	resp, err := cli.SendText(ctx, "!foo:bar", "hello")
+package gomatrixtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/globekeeper/gomatrix"
+)
+
+// The credentials used by clients created with NewTestClient.
+const (
+	TestUserID      = "@user:test.gomatrix.org"
+	TestAccessToken = "test_access_token"
+)
+
+// NewTestClient starts an httptest.Server serving handler and returns a Client pointed at it, logged in as
+// TestUserID with TestAccessToken and using the default prefix. The server is closed when the test finishes.
+func NewTestClient(t testing.TB, handler http.Handler) *gomatrix.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	cli, err := gomatrix.NewClient(srv.URL, TestUserID, TestAccessToken)
+	if err != nil {
+		t.Fatalf("gomatrixtest: failed to create client: %s", err)
+	}
+	cli.Client = srv.Client()
+	return cli
+}
+
+// WriteJSON writes body as a JSON response with the given status code.
+func WriteJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// WriteError writes a standard Matrix error response with the given status code, e.g.
+// WriteError(w, http.StatusForbidden, gomatrix.ErrCodeForbidden, "You are not invited to this room.")
+func WriteError(w http.ResponseWriter, status int, errCode, message string) {
+	WriteJSON(w, status, gomatrix.RespError{ErrCode: errCode, Err: message})
+}
+
+// NewEvent returns a message event with the given type, sender and content.
+func NewEvent(eventType, sender string, content map[string]interface{}) gomatrix.Event {
+	return gomatrix.Event{
+		Type:    eventType,
+		Sender:  sender,
+		Content: content,
+	}
+}
+
+// NewStateEvent returns a state event with the given type, state key, sender and content.
+func NewStateEvent(eventType, stateKey, sender string, content map[string]interface{}) gomatrix.Event {
+	ev := NewEvent(eventType, sender, content)
+	ev.StateKey = &stateKey
+	return ev
+}
+
+// NewTextMessage returns an m.room.message event with a msgtype of m.text.
+func NewTextMessage(sender, body string) gomatrix.Event {
+	return NewEvent("m.room.message", sender, map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    body,
+	})
+}
+
+// NewMembershipEvent returns an m.room.member event setting the membership of userID.
+func NewMembershipEvent(sender, userID, membership string) gomatrix.Event {
+	return NewStateEvent("m.room.member", userID, sender, map[string]interface{}{
+		"membership": membership,
+	})
+}
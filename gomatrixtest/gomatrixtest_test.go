@@ -0,0 +1,51 @@
+package gomatrixtest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/globekeeper/gomatrix"
+)
+
+func TestNewTestClient(t *testing.T) {
+	cli := NewTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+TestAccessToken {
+			WriteError(w, http.StatusUnauthorized, gomatrix.ErrCodeMissingToken, "Missing access token")
+			return
+		}
+		switch r.URL.Path {
+		case "/_matrix/client/r0/sync":
+			_, _ = w.Write(NewSyncBuilder("s2").AddJoinedTimeline("!foo:bar", NewTextMessage("@alice:bar", "hello")).JSON())
+		default:
+			WriteError(w, http.StatusNotFound, gomatrix.ErrCodeNotFound, "Not found")
+		}
+	}))
+
+	res, err := cli.SyncRequest(context.Background(), 0, "", "", false, "")
+	if err != nil {
+		t.Fatalf("SyncRequest: error, got %s", err)
+	}
+	if res.NextBatch != "s2" {
+		t.Fatalf("SyncRequest: got next_batch %s, want s2", res.NextBatch)
+	}
+	events := res.Rooms.Join["!foo:bar"].Timeline.Events
+	if len(events) != 1 {
+		t.Fatalf("SyncRequest: got %d timeline events, want 1", len(events))
+	}
+	if body, _ := events[0].Body(); body != "hello" {
+		t.Fatalf("SyncRequest: got body %q, want hello", body)
+	}
+
+	if _, err := cli.JoinedRooms(context.Background()); !gomatrix.IsMatrixError(err, gomatrix.ErrCodeNotFound) {
+		t.Fatalf("JoinedRooms: got %v, want M_NOT_FOUND", err)
+	}
+}
+
+func TestSyncBuilder_Invite(t *testing.T) {
+	res := NewSyncBuilder("s1").AddInvite("!foo:bar", "@alice:bar", TestUserID).Build()
+	events := res.Rooms.Invite["!foo:bar"].State.Events
+	if len(events) != 1 || events[0].Sender != "@alice:bar" || *events[0].StateKey != TestUserID {
+		t.Fatalf("AddInvite: got %+v", events)
+	}
+}
@@ -0,0 +1,157 @@
+package gomatrixtest
+
+import (
+	"encoding/json"
+
+	"github.com/globekeeper/gomatrix"
+)
+
+// SyncBuilder builds canned /sync responses. Use Build to get a RespSync to pass to a Syncer directly, or JSON to
+// serve it from a test handler.
+type SyncBuilder struct {
+	NextBatch string
+
+	accountData []gomatrix.Event
+	presence    []gomatrix.Event
+	join        map[string]*syncRoom
+	invite      map[string]*syncRoom
+	leave       map[string]*syncRoom
+}
+
+type syncEvents struct {
+	Events []gomatrix.Event `json:"events"`
+}
+
+type syncTimeline struct {
+	Events    []gomatrix.Event `json:"events"`
+	Limited   bool             `json:"limited,omitempty"`
+	PrevBatch string           `json:"prev_batch,omitempty"`
+}
+
+type syncRoom struct {
+	State       *syncEvents   `json:"state,omitempty"`
+	InviteState *syncEvents   `json:"invite_state,omitempty"`
+	Timeline    *syncTimeline `json:"timeline,omitempty"`
+	Ephemeral   *syncEvents   `json:"ephemeral,omitempty"`
+	AccountData *syncEvents   `json:"account_data,omitempty"`
+}
+
+// NewSyncBuilder returns an empty SyncBuilder with the given next_batch token.
+func NewSyncBuilder(nextBatch string) *SyncBuilder {
+	return &SyncBuilder{
+		NextBatch: nextBatch,
+		join:      make(map[string]*syncRoom),
+		invite:    make(map[string]*syncRoom),
+		leave:     make(map[string]*syncRoom),
+	}
+}
+
+func room(rooms map[string]*syncRoom, roomID string) *syncRoom {
+	r, ok := rooms[roomID]
+	if !ok {
+		r = &syncRoom{}
+		rooms[roomID] = r
+	}
+	return r
+}
+
+// AddJoinedState adds state events to a joined room.
+func (b *SyncBuilder) AddJoinedState(roomID string, events ...gomatrix.Event) *SyncBuilder {
+	r := room(b.join, roomID)
+	if r.State == nil {
+		r.State = &syncEvents{}
+	}
+	r.State.Events = append(r.State.Events, events...)
+	return b
+}
+
+// AddJoinedTimeline adds timeline events to a joined room.
+func (b *SyncBuilder) AddJoinedTimeline(roomID string, events ...gomatrix.Event) *SyncBuilder {
+	r := room(b.join, roomID)
+	if r.Timeline == nil {
+		r.Timeline = &syncTimeline{}
+	}
+	r.Timeline.Events = append(r.Timeline.Events, events...)
+	return b
+}
+
+// AddJoinedEphemeral adds ephemeral events, such as m.typing, to a joined room.
+func (b *SyncBuilder) AddJoinedEphemeral(roomID string, events ...gomatrix.Event) *SyncBuilder {
+	r := room(b.join, roomID)
+	if r.Ephemeral == nil {
+		r.Ephemeral = &syncEvents{}
+	}
+	r.Ephemeral.Events = append(r.Ephemeral.Events, events...)
+	return b
+}
+
+// AddJoinedAccountData adds per-room account data, such as m.tag, to a joined room.
+func (b *SyncBuilder) AddJoinedAccountData(roomID string, events ...gomatrix.Event) *SyncBuilder {
+	r := room(b.join, roomID)
+	if r.AccountData == nil {
+		r.AccountData = &syncEvents{}
+	}
+	r.AccountData.Events = append(r.AccountData.Events, events...)
+	return b
+}
+
+// AddInvite adds an invite for userID to roomID, sent by inviter, along with any extra stripped state events.
+func (b *SyncBuilder) AddInvite(roomID, inviter, userID string, state ...gomatrix.Event) *SyncBuilder {
+	r := room(b.invite, roomID)
+	if r.InviteState == nil {
+		r.InviteState = &syncEvents{}
+	}
+	r.InviteState.Events = append(r.InviteState.Events, state...)
+	r.InviteState.Events = append(r.InviteState.Events, NewMembershipEvent(inviter, userID, "invite"))
+	return b
+}
+
+// AddLeftTimeline adds timeline events to a room which has been left.
+func (b *SyncBuilder) AddLeftTimeline(roomID string, events ...gomatrix.Event) *SyncBuilder {
+	r := room(b.leave, roomID)
+	if r.Timeline == nil {
+		r.Timeline = &syncTimeline{}
+	}
+	r.Timeline.Events = append(r.Timeline.Events, events...)
+	return b
+}
+
+// AddPresence adds m.presence events.
+func (b *SyncBuilder) AddPresence(events ...gomatrix.Event) *SyncBuilder {
+	b.presence = append(b.presence, events...)
+	return b
+}
+
+// AddAccountData adds global account data events.
+func (b *SyncBuilder) AddAccountData(events ...gomatrix.Event) *SyncBuilder {
+	b.accountData = append(b.accountData, events...)
+	return b
+}
+
+// JSON returns the response as it would be sent by a homeserver.
+func (b *SyncBuilder) JSON() []byte {
+	out, err := json.Marshal(map[string]interface{}{
+		"next_batch":   b.NextBatch,
+		"account_data": syncEvents{Events: b.accountData},
+		"presence":     syncEvents{Events: b.presence},
+		"rooms": map[string]interface{}{
+			"join":   b.join,
+			"invite": b.invite,
+			"leave":  b.leave,
+		},
+	})
+	if err != nil {
+		// Only events with unmarshallable content can get here, which is a bug in the test.
+		panic(err)
+	}
+	return out
+}
+
+// Build returns the response as a RespSync.
+func (b *SyncBuilder) Build() *gomatrix.RespSync {
+	var res gomatrix.RespSync
+	if err := json.Unmarshal(b.JSON(), &res); err != nil {
+		panic(err)
+	}
+	return &res
+}
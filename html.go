@@ -0,0 +1,336 @@
+package gomatrix
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlSkipContent is the set of elements whose content is never displayed and is dropped when converting to text.
+var htmlSkipContent = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"head":     true,
+	"title":    true,
+	"template": true,
+	"iframe":   true,
+	"object":   true,
+	"noscript": true,
+}
+
+// htmlBlockTags is the set of elements which are separated from the surrounding text by a line break when converting
+// to text.
+var htmlBlockTags = map[string]bool{
+	"p":          true,
+	"div":        true,
+	"li":         true,
+	"blockquote": true,
+}
+
+// HTMLToText returns the text content of an HTML fragment with all tags removed and entities decoded. The content of
+// elements which are not displayed, such as <script> and <style>, is dropped, as are comments. <br> becomes a line
+// break, and paragraphs, divs, list items and blockquotes start on a new line.
+func HTMLToText(htmlText string) string {
+	var buf strings.Builder
+	z := html.NewTokenizer(strings.NewReader(htmlText))
+	skipDepth := 0
+	newline := false // whether a block element started or ended since the last text
+	for {
+		switch tt := z.Next(); tt {
+		case html.ErrorToken:
+			return buf.String()
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			if newline && buf.Len() > 0 && !strings.HasSuffix(buf.String(), "\n") {
+				buf.WriteByte('\n')
+			}
+			newline = false
+			buf.Write(z.Text())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch {
+			case htmlSkipContent[string(name)]:
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+			case skipDepth > 0:
+			case string(name) == "br":
+				buf.WriteByte('\n')
+			case htmlBlockTags[string(name)]:
+				newline = true
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if htmlSkipContent[string(name)] && skipDepth > 0 {
+				skipDepth--
+			} else if htmlBlockTags[string(name)] {
+				newline = true
+			}
+		}
+	}
+}
+
+// htmlAllowedTags is the set of tags, and for each tag its allowed attributes, that clients should permit in
+// formatted_body. See https://spec.matrix.org/v1.7/client-server-api/#mroommessage-msgtypes
+var htmlAllowedTags = map[string][]string{
+	"font":       {"data-mx-bg-color", "data-mx-color", "color"},
+	"del":        nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"blockquote": nil,
+	"p":          nil,
+	"a":          {"name", "target", "href"},
+	"ul":         nil,
+	"ol":         {"start"},
+	"sup":        nil,
+	"sub":        nil,
+	"li":         nil,
+	"b":          nil,
+	"i":          nil,
+	"u":          nil,
+	"strong":     nil,
+	"em":         nil,
+	"strike":     nil,
+	"code":       {"class"},
+	"hr":         nil,
+	"br":         nil,
+	"div":        nil,
+	"table":      nil,
+	"thead":      nil,
+	"tbody":      nil,
+	"tr":         nil,
+	"th":         nil,
+	"td":         nil,
+	"caption":    nil,
+	"pre":        nil,
+	"span":       {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler"},
+	"img":        {"width", "height", "alt", "title", "src"},
+	"details":    nil,
+	"summary":    nil,
+	"mx-reply":   nil,
+}
+
+// htmlVoidTags are allowed tags which never have content or an end tag.
+var htmlVoidTags = map[string]bool{
+	"br":  true,
+	"hr":  true,
+	"img": true,
+}
+
+// htmlAllowedSchemes are the URL schemes allowed in the href attribute of links.
+var htmlAllowedSchemes = []string{"http:", "https:", "ftp:", "mailto:", "magnet:"}
+
+// htmlMaxBlockquoteDepth is the maximum nesting of <blockquote> kept by SanitizeMatrixHTML.
+const htmlMaxBlockquoteDepth = 10
+
+// SanitizeMatrixHTML sanitizes the formatted_body of a message received from another user so that it is safe to
+// display. Only the tags and attributes allowed by the Matrix spec are kept; other tags are removed but their text is
+// kept, except for elements such as <script> whose content is removed too. Links are only kept for safe URL schemes,
+// and <blockquote> elements nested more than 10 deep are flattened.
+//
+// Images must have an mxc:// source, which is converted to an HTTP URL with mxcToHTTP. Images are removed if mxcToHTTP
+// is nil or returns an empty string.
+func SanitizeMatrixHTML(htmlText string, mxcToHTTP func(string) string) string {
+	var (
+		buf               strings.Builder
+		open              []string // allowed elements which have been written but not closed, innermost last
+		skipDepth         int      // depth of elements whose content is being dropped
+		blockquoteDepth   int
+		droppedBlockquote int // number of open <blockquote> elements which were dropped for being too deep
+	)
+	z := html.NewTokenizer(strings.NewReader(htmlText))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				buf.WriteString("</" + open[i] + ">")
+			}
+			return buf.String()
+		case html.TextToken:
+			if skipDepth == 0 {
+				buf.WriteString(html.EscapeString(string(z.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if htmlSkipContent[tok.Data] {
+				if tt == html.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			attrs, ok := sanitizeHTMLAttrs(tok, mxcToHTTP)
+			if !ok {
+				continue
+			}
+			if tok.Data == "blockquote" {
+				if blockquoteDepth >= htmlMaxBlockquoteDepth {
+					if tt == html.StartTagToken {
+						droppedBlockquote++
+					}
+					continue
+				}
+				blockquoteDepth++
+			}
+			buf.WriteString("<" + tok.Data)
+			for _, attr := range attrs {
+				buf.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			buf.WriteString(">")
+			if htmlVoidTags[tok.Data] {
+				continue
+			}
+			if tt == html.SelfClosingTagToken {
+				if tok.Data == "blockquote" {
+					blockquoteDepth--
+				}
+				buf.WriteString("</" + tok.Data + ">")
+				continue
+			}
+			open = append(open, tok.Data)
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if htmlSkipContent[tag] {
+				if skipDepth > 0 {
+					skipDepth--
+				}
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+			if tag == "blockquote" && droppedBlockquote > 0 {
+				droppedBlockquote--
+				continue
+			}
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != tag {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					if open[j] == "blockquote" {
+						blockquoteDepth--
+					}
+					buf.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+}
+
+// sanitizeHTMLAttrs returns the allowed attributes of tok, or false if the element should not be written at all.
+func sanitizeHTMLAttrs(tok html.Token, mxcToHTTP func(string) string) ([]html.Attribute, bool) {
+	allowed, ok := htmlAllowedTags[tok.Data]
+	if !ok {
+		return nil, false
+	}
+	var attrs []html.Attribute
+	for _, attr := range tok.Attr {
+		if attr.Namespace != "" || !containsString(allowed, attr.Key) {
+			continue
+		}
+		switch attr.Key {
+		case "href":
+			if !hasAllowedScheme(attr.Val) {
+				continue
+			}
+		case "src":
+			if mxcToHTTP == nil || !strings.HasPrefix(attr.Val, "mxc://") {
+				continue
+			}
+			if attr.Val = mxcToHTTP(attr.Val); attr.Val == "" {
+				continue
+			}
+		case "class":
+			if !strings.HasPrefix(attr.Val, "language-") || strings.ContainsAny(attr.Val, " \t\n") {
+				continue
+			}
+		case "color", "data-mx-color", "data-mx-bg-color":
+			if !isHexColor(attr.Val) {
+				continue
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+	if tok.Data == "img" {
+		hasSrc := false
+		for _, attr := range attrs {
+			hasSrc = hasSrc || attr.Key == "src"
+		}
+		if !hasSrc {
+			return nil, false
+		}
+	}
+	return attrs, true
+}
+
+func hasAllowedScheme(href string) bool {
+	href = strings.ToLower(strings.TrimSpace(href))
+	for _, scheme := range htmlAllowedSchemes {
+		if strings.HasPrefix(href, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHexColor(s string) bool {
+	if len(s) != 7 || s[0] != '#' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StripReplyFallbackHTML removes the <mx-reply> block containing the quoted original message from the formatted_body
+// of a reply. The rest of the HTML is returned unchanged.
+// See https://spec.matrix.org/v1.7/client-server-api/#fallbacks-for-rich-replies
+func StripReplyFallbackHTML(htmlText string) string {
+	var buf strings.Builder
+	z := html.NewTokenizer(strings.NewReader(htmlText))
+	depth := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return buf.String()
+		}
+		if tt == html.StartTagToken || tt == html.EndTagToken {
+			if name, _ := z.TagName(); string(name) == "mx-reply" {
+				if tt == html.StartTagToken {
+					depth++
+				} else if depth > 0 {
+					depth--
+				}
+				continue
+			}
+		}
+		if depth == 0 {
+			buf.Write(z.Raw())
+		}
+	}
+}
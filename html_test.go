@@ -0,0 +1,71 @@
+package gomatrix
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := map[string]string{
+		`<b>bold</b> text`: "bold text",
+		`a &lt; b &amp;&amp; c &gt; d &eacute;&#x1F600;`: "a < b && c > d é😀",
+		`a < b`:                                         "a < b",
+		`x<script>alert("<b>hi</b>")</script>y`:         "xy",
+		`<style>p { color: red }</style>styled`:         "styled",
+		`before<!-- <b>comment</b> -->after`:            "beforeafter",
+		`<ul><li><em>nested <b>tags</b></em></li></ul>`: "nested tags",
+		`line 1<br>line 2<br/>line 3`:                   "line 1\nline 2\nline 3",
+		`<p>one</p><p>two</p>`:                          "one\ntwo",
+		`<div>a</div>b<div>c</div>`:                     "a\nb\nc",
+		`<ul><li>x</li><li>y</li></ul>`:                 "x\ny",
+		`<blockquote>quote</blockquote>reply`:           "quote\nreply",
+		`<p>a<script>x</script></p><p>b</p>`:            "a\nb",
+	}
+	for in, want := range tests {
+		if got := HTMLToText(in); got != want {
+			t.Errorf("HTMLToText(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSanitizeMatrixHTML(t *testing.T) {
+	mxcToHTTP := func(mxc string) string {
+		return "https://example.org/_matrix/media/r0/download/" + mxc[len("mxc://"):]
+	}
+	tests := map[string]string{
+		`<b>bold</b> <script>alert(1)</script>text`:                      `<b>bold</b> text`,
+		`<p onclick="evil()" style="x">para</p>`:                         `<p>para</p>`,
+		`<a href="javascript:alert(1)">x</a><a href="https://a.b">y</a>`: `<a>x</a><a href="https://a.b">y</a>`,
+		`<marquee>a &lt; b</marquee>`:                                    `a &lt; b`,
+		`<img src="mxc://server/id" alt="pic"><img src="https://x/y">`:   `<img src="https://example.org/_matrix/media/r0/download/server/id" alt="pic">`,
+		`<code class="language-go">x</code><code class="evil">y</code>`:  `<code class="language-go">x</code><code>y</code>`,
+		`<font color="#ff0000" data-mx-bg-color="red">c</font>`:          `<font color="#ff0000">c</font>`,
+		`<b><i>unclosed`: `<b><i>unclosed</i></b>`,
+		`</b>stray<br/>`: `stray<br>`,
+		`<mx-reply><blockquote>quoted</blockquote></mx-reply>reply`: `<mx-reply><blockquote>quoted</blockquote></mx-reply>reply`,
+	}
+	for in, want := range tests {
+		if got := SanitizeMatrixHTML(in, mxcToHTTP); got != want {
+			t.Errorf("SanitizeMatrixHTML(%q): got %q, want %q", in, got, want)
+		}
+	}
+
+	nested := strings.Repeat("<blockquote>", 20) + "deep" + strings.Repeat("</blockquote>", 20)
+	want := strings.Repeat("<blockquote>", htmlMaxBlockquoteDepth) + "deep" + strings.Repeat("</blockquote>", htmlMaxBlockquoteDepth)
+	if got := SanitizeMatrixHTML(nested, nil); got != want {
+		t.Errorf("SanitizeMatrixHTML: got %q for deeply nested blockquotes, want %q", got, want)
+	}
+	if got := SanitizeMatrixHTML(`<img src="mxc://server/id">`, nil); got != "" {
+		t.Errorf("SanitizeMatrixHTML: got %q for image without mxcToHTTP, want it removed", got)
+	}
+}
+
+func TestStripReplyFallbackHTML(t *testing.T) {
+	in := `<mx-reply><blockquote><a href="https://matrix.to/#/!room:bar/$ev">In reply to</a> <a href="https://matrix.to/#/@alice:bar">@alice:bar</a><br>line 1<br>line 2</blockquote></mx-reply>My <b>answer</b> &amp; more`
+	if got, want := StripReplyFallbackHTML(in), `My <b>answer</b> &amp; more`; got != want {
+		t.Fatalf("StripReplyFallbackHTML: got %q, want %q", got, want)
+	}
+	if got := StripReplyFallbackHTML(`<p>no reply</p>`); got != `<p>no reply</p>` {
+		t.Fatalf("StripReplyFallbackHTML: got %q for a message without a fallback", got)
+	}
+}
@@ -38,7 +38,7 @@ func (i ThirdpartyIdentifier) Type() string {
 	return "m.id.thirdparty"
 }
 
-// NewThirdpartyIdentifier creates a new UserIdentifier with IDType set to "m.id.user"
+// NewThirdpartyIdentifier creates a new ThirdpartyIdentifier with IDType set to "m.id.thirdparty"
 func NewThirdpartyIdentifier(medium, address string) ThirdpartyIdentifier {
 	return ThirdpartyIdentifier{
 		IDType:  "m.id.thirdparty",
@@ -59,7 +59,7 @@ func (i PhoneIdentifier) Type() string {
 	return "m.id.phone"
 }
 
-// NewPhoneIdentifier creates a new UserIdentifier with IDType set to "m.id.user"
+// NewPhoneIdentifier creates a new PhoneIdentifier with IDType set to "m.id.phone"
 func NewPhoneIdentifier(country, phone string) PhoneIdentifier {
 	return PhoneIdentifier{
 		IDType:  "m.id.phone",
@@ -0,0 +1,151 @@
+package gomatrix
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ParseMatrixToURL parses a https://matrix.to/#/... link to a room ID, room alias or user ID, optionally followed by
+// an event ID, and the via servers given in the link. eventID is empty if the link is not an event permalink.
+// See https://spec.matrix.org/v1.7/appendices/#matrixto-navigation
+func ParseMatrixToURL(s string) (identifier string, via []string, eventID string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host != "matrix.to" {
+		return "", nil, "", fmt.Errorf("not a matrix.to link: %s", s)
+	}
+	fragment := u.EscapedFragment()
+	if !strings.HasPrefix(fragment, "/") {
+		return "", nil, "", fmt.Errorf("invalid matrix.to link: %s", s)
+	}
+	fragment, rawQuery := splitQuery(fragment[1:])
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("invalid matrix.to link query: %w", err)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(fragment, "/") {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("invalid matrix.to link: %w", err)
+		}
+		parts = append(parts, unescaped)
+	}
+	identifier = parts[0]
+	switch {
+	case len(identifier) < 2:
+		return "", nil, "", fmt.Errorf("invalid matrix.to link: %s", s)
+	case identifier[0] == '@' && len(parts) == 1:
+	case (identifier[0] == '!' || identifier[0] == '#') && len(parts) == 1:
+	case (identifier[0] == '!' || identifier[0] == '#') && len(parts) == 2 && strings.HasPrefix(parts[1], "$"):
+		eventID = parts[1]
+	default:
+		return "", nil, "", fmt.Errorf("unsupported matrix.to link: %s", s)
+	}
+	return identifier, query["via"], eventID, nil
+}
+
+// RoomPermalink returns a matrix.to link to a room ID or alias. via should list a few servers in the room, so that
+// the link can be joined through them; it is usually only needed for room IDs.
+// See https://spec.matrix.org/v1.7/appendices/#routing
+func RoomPermalink(roomIDorAlias string, via []string) string {
+	return matrixToURL(via, roomIDorAlias)
+}
+
+// EventPermalink returns a matrix.to link to an event in a room. See RoomPermalink for via.
+func EventPermalink(roomID, eventID string, via []string) string {
+	return matrixToURL(via, roomID, eventID)
+}
+
+// UserPermalink returns a matrix.to link to a user ID.
+func UserPermalink(userID string) string {
+	return matrixToURL(nil, userID)
+}
+
+func matrixToURL(via []string, identifiers ...string) string {
+	var buf strings.Builder
+	buf.WriteString("https://matrix.to/#")
+	for _, id := range identifiers {
+		buf.WriteByte('/')
+		buf.WriteString(escapeMatrixToIdentifier(id))
+	}
+	if len(via) > 0 {
+		buf.WriteByte('?')
+		buf.WriteString(url.Values{"via": via}.Encode())
+	}
+	return buf.String()
+}
+
+// escapeMatrixToIdentifier percent-encodes every byte of id except unreserved characters, as in the examples of the
+// spec, e.g. %23somewhere%3Aexample.org.
+func escapeMatrixToIdentifier(id string) string {
+	const hex = "0123456789ABCDEF"
+	var buf strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(hex[c>>4])
+		buf.WriteByte(hex[c&15])
+	}
+	return buf.String()
+}
+
+// matrixURIKinds maps the type segments of a matrix: URI to the sigil of the identifier which follows them.
+var matrixURIKinds = map[string]byte{
+	"u":      '@',
+	"r":      '#',
+	"roomid": '!',
+}
+
+// ParseMatrixURI parses a matrix: URI, such as matrix:r/alias:example.org/e/event or matrix:u/user:example.org,
+// returning the same values as ParseMatrixToURL. Identifiers are returned with their sigils.
+// See https://spec.matrix.org/v1.7/appendices/#matrix-uri-scheme
+func ParseMatrixURI(s string) (identifier string, via []string, eventID string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if u.Scheme != "matrix" || u.Opaque == "" {
+		return "", nil, "", fmt.Errorf("not a matrix: uri: %s", s)
+	}
+	parts := strings.Split(u.Opaque, "/")
+	if len(parts) != 2 && len(parts) != 4 {
+		return "", nil, "", fmt.Errorf("invalid matrix: uri: %s", s)
+	}
+	for i := range parts {
+		if parts[i], err = url.PathUnescape(parts[i]); err != nil {
+			return "", nil, "", fmt.Errorf("invalid matrix: uri: %w", err)
+		}
+		if parts[i] == "" {
+			return "", nil, "", fmt.Errorf("invalid matrix: uri: %s", s)
+		}
+	}
+	sigil, ok := matrixURIKinds[parts[0]]
+	if !ok {
+		return "", nil, "", fmt.Errorf("unsupported matrix: uri type %q", parts[0])
+	}
+	identifier = string(sigil) + parts[1]
+	if len(parts) == 4 {
+		if sigil == '@' || parts[2] != "e" {
+			return "", nil, "", fmt.Errorf("unsupported matrix: uri: %s", s)
+		}
+		eventID = "$" + parts[3]
+	}
+	return identifier, u.Query()["via"], eventID, nil
+}
+
+// splitQuery splits s at the first '?'.
+func splitQuery(s string) (path, query string) {
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
@@ -0,0 +1,87 @@
+package gomatrix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMatrixToURL(t *testing.T) {
+	tests := []struct {
+		in         string
+		identifier string
+		via        []string
+		eventID    string
+	}{
+		{"https://matrix.to/#/%23foo%3Abar.org", "#foo:bar.org", nil, ""},
+		{"https://matrix.to/#/#foo:bar.org", "#foo:bar.org", nil, ""},
+		{"https://matrix.to/#/@alice:bar.org", "@alice:bar.org", nil, ""},
+		{"https://matrix.to/#/!abc%3Abar.org?via=bar.org&via=example.org", "!abc:bar.org", []string{"bar.org", "example.org"}, ""},
+		{"https://matrix.to/#/!abc:bar.org/%24ev%2Fent?via=bar.org", "!abc:bar.org", []string{"bar.org"}, "$ev/ent"},
+	}
+	for _, test := range tests {
+		identifier, via, eventID, err := ParseMatrixToURL(test.in)
+		if err != nil {
+			t.Errorf("ParseMatrixToURL(%s): error, got %s", test.in, err)
+			continue
+		}
+		if identifier != test.identifier || !reflect.DeepEqual(via, test.via) || eventID != test.eventID {
+			t.Errorf("ParseMatrixToURL(%s): got %s %v %s, want %s %v %s", test.in, identifier, via, eventID, test.identifier, test.via, test.eventID)
+		}
+	}
+	for _, invalid := range []string{"https://example.org/#/@alice:bar.org", "https://matrix.to/#/", "https://matrix.to/#/@alice:bar.org/$ev", "https://matrix.to/#/!abc:bar.org/notanevent"} {
+		if _, _, _, err := ParseMatrixToURL(invalid); err == nil {
+			t.Errorf("ParseMatrixToURL(%s): expected error, got nil", invalid)
+		}
+	}
+}
+
+func TestParseMatrixURI(t *testing.T) {
+	tests := []struct {
+		in         string
+		identifier string
+		via        []string
+		eventID    string
+	}{
+		{"matrix:r/foo:bar.org", "#foo:bar.org", nil, ""},
+		{"matrix:u/alice:bar.org?action=chat", "@alice:bar.org", nil, ""},
+		{"matrix:roomid/abc:bar.org?via=bar.org&via=example.org", "!abc:bar.org", []string{"bar.org", "example.org"}, ""},
+		{"matrix:roomid/abc:bar.org/e/ev%2Fent", "!abc:bar.org", nil, "$ev/ent"},
+	}
+	for _, test := range tests {
+		identifier, via, eventID, err := ParseMatrixURI(test.in)
+		if err != nil {
+			t.Errorf("ParseMatrixURI(%s): error, got %s", test.in, err)
+			continue
+		}
+		if identifier != test.identifier || !reflect.DeepEqual(via, test.via) || eventID != test.eventID {
+			t.Errorf("ParseMatrixURI(%s): got %s %v %s, want %s %v %s", test.in, identifier, via, eventID, test.identifier, test.via, test.eventID)
+		}
+	}
+	for _, invalid := range []string{"https://matrix.to/#/@alice:bar.org", "matrix:x/foo:bar.org", "matrix:u/alice:bar.org/e/ev", "matrix:r/"} {
+		if _, _, _, err := ParseMatrixURI(invalid); err == nil {
+			t.Errorf("ParseMatrixURI(%s): expected error, got nil", invalid)
+		}
+	}
+}
+
+func TestPermalinks(t *testing.T) {
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{RoomPermalink("#foo:bar.org", nil), "https://matrix.to/#/%23foo%3Abar.org"},
+		{RoomPermalink("!abc:bar.org", []string{"bar.org", "example.org"}), "https://matrix.to/#/%21abc%3Abar.org?via=bar.org&via=example.org"},
+		{EventPermalink("!abc:bar.org", "$ev/ent+1", []string{"bar.org"}), "https://matrix.to/#/%21abc%3Abar.org/%24ev%2Fent%2B1?via=bar.org"},
+		{UserPermalink("@alice:bar.org"), "https://matrix.to/#/%40alice%3Abar.org"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("got %s, want %s", test.got, test.want)
+		}
+	}
+
+	identifier, via, eventID, err := ParseMatrixToURL(EventPermalink("!abc:bar.org", "$ev/ent+1", []string{"bar.org"}))
+	if err != nil || identifier != "!abc:bar.org" || eventID != "$ev/ent+1" || len(via) != 1 {
+		t.Fatalf("ParseMatrixToURL(EventPermalink(...)): got %s %v %s %v", identifier, via, eventID, err)
+	}
+}
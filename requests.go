@@ -1,5 +1,10 @@
 package gomatrix
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // ReqRegister is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-register
 type ReqRegister struct {
 	Username                 string      `json:"username,omitempty"`
@@ -26,6 +31,12 @@ type ReqLogin struct {
 	TotpSid                  string     `json:"totp_sid"`
 	Passcode                 string     `json:"passcode"`
 	Sid                      string     `json:"sid,omitempty"`
+	RefreshToken             bool       `json:"refresh_token,omitempty"` // Ask the homeserver to issue a refresh token
+}
+
+// ReqRefresh is the JSON request for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+type ReqRefresh struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 // ReqCreateRoom is the JSON request for https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
@@ -41,6 +52,76 @@ type ReqCreateRoom struct {
 	Preset          string                 `json:"preset,omitempty"`
 	IsDirect        bool                   `json:"is_direct,omitempty"`
 	RoomVersion     string                 `json:"room_version,omitempty"`
+	// Keys of the m.room.power_levels content to override on top of the preset, e.g. {"users": {"@bot:example.org": 100}}.
+	// Only the given keys are sent, so the preset's levels are kept for the rest.
+	PowerLevelContentOverride map[string]interface{} `json:"power_level_content_override,omitempty"`
+}
+
+// AddInitialState appends a state event with the given type, state key and content to InitialState.
+// content may be any value which marshals to a JSON object, such as a map or one of the *EventContent structs.
+func (req *ReqCreateRoom) AddInitialState(eventType, stateKey string, content interface{}) error {
+	ev := Event{Type: eventType, StateKey: &stateKey}
+	if err := ev.SetContent(content); err != nil {
+		return err
+	}
+	req.InitialState = append(req.InitialState, ev)
+	return nil
+}
+
+// AddInitialStateContents adds a state event with the empty state key to InitialState for each of the given typed
+// contents, so that the room is created with all of them at once rather than with a state event sent for each after
+// CreateRoom. The event type is derived from the type of the content, which may be a NameEventContent,
+// TopicEventContent, JoinRulesEventContent, RoomAvatarEventContent, GuestAccessEventContent,
+// EncryptionEventContent or CanonicalAliasEventContent, or a pointer to one. An event of the same type already in
+// InitialState is replaced. Nothing is added if any content has an unsupported type.
+func (req *ReqCreateRoom) AddInitialStateContents(contents ...interface{}) error {
+	events := make([]Event, len(contents))
+	for i, content := range contents {
+		eventType, ok := initialStateEventType(content)
+		if !ok {
+			return fmt.Errorf("unsupported initial state content type %T", content)
+		}
+		stateKey := ""
+		events[i] = Event{Type: eventType, StateKey: &stateKey}
+		if err := events[i].SetContent(content); err != nil {
+			return err
+		}
+	}
+	for _, ev := range events {
+		replaced := false
+		for i, existing := range req.InitialState {
+			if existing.Type == ev.Type && existing.StateKey != nil && *existing.StateKey == "" {
+				req.InitialState[i] = ev
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			req.InitialState = append(req.InitialState, ev)
+		}
+	}
+	return nil
+}
+
+// initialStateEventType returns the event type of a typed state event content supported by AddInitialStateContents.
+func initialStateEventType(content interface{}) (string, bool) {
+	switch content.(type) {
+	case NameEventContent, *NameEventContent:
+		return "m.room.name", true
+	case TopicEventContent, *TopicEventContent:
+		return "m.room.topic", true
+	case JoinRulesEventContent, *JoinRulesEventContent:
+		return "m.room.join_rules", true
+	case RoomAvatarEventContent, *RoomAvatarEventContent:
+		return "m.room.avatar", true
+	case GuestAccessEventContent, *GuestAccessEventContent:
+		return "m.room.guest_access", true
+	case EncryptionEventContent, *EncryptionEventContent:
+		return "m.room.encryption", true
+	case CanonicalAliasEventContent, *CanonicalAliasEventContent:
+		return "m.room.canonical_alias", true
+	}
+	return "", false
 }
 
 // ReqRedact is the JSON request for http://matrix.org/docs/spec/client_server/r0.2.0.html#put-matrix-client-r0-rooms-roomid-redact-eventid-txnid
@@ -48,6 +129,21 @@ type ReqRedact struct {
 	Reason string `json:"reason,omitempty"`
 }
 
+// ReqJoinRoom is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-join-roomidoralias
+type ReqJoinRoom struct {
+	Reason           string            `json:"reason,omitempty"`
+	ThirdPartySigned *ThirdPartySigned `json:"third_party_signed,omitempty"`
+}
+
+// ThirdPartySigned is the signed third-party invite used to join a room which the user was invited to by 3PID.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-rooms-roomid-join
+type ThirdPartySigned struct {
+	Sender     string                       `json:"sender"`
+	MXID       string                       `json:"mxid"`
+	Token      string                       `json:"token"`
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
 // ReqInvite3PID is the JSON request for https://matrix.org/docs/spec/client_server/r0.2.0.html#id57
 // It is also a JSON object used in https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type ReqInvite3PID struct {
@@ -110,6 +206,13 @@ type ReqEmailRequestToken struct {
 	NextLink      string `json:"next_link,omitempty"`
 }
 
+// ReqSubmitToken is the JSON request for https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-validate-msisdn-submittoken
+type ReqSubmitToken struct {
+	Sid          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
 type ReqPostThreePID struct {
 	ThreePIDCredes ThreePIDCreds `json:"three_pid_creds"`
 }
@@ -121,10 +224,34 @@ type ThreePIDCreds struct {
 	Sid           string `json:"sid"`
 }
 
+// ReqAdd3PID is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-add
+type ReqAdd3PID struct {
+	Auth         interface{} `json:"auth,omitempty"`
+	ClientSecret string      `json:"client_secret"`
+	Sid          string      `json:"sid"`
+}
+
+// ReqBind3PID is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-bind
+type ReqBind3PID struct {
+	ClientSecret  string `json:"client_secret"`
+	IDAccessToken string `json:"id_access_token"`
+	IDServer      string `json:"id_server"`
+	Sid           string `json:"sid"`
+}
+
+// ReqDeleteThreePID is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-delete
+type ReqDeleteThreePID struct {
+	IDServer string `json:"id_server,omitempty"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
+}
+
 type ReqHierarchy struct {
 	RoomId        string
 	SuggestedOnly bool
 	Limit         int
+	From          string // The NextBatch of a previous RespHierarchy, to fetch the next page
+	MaxDepth      int    // Maximum depth of rooms to return. 0 uses the homeserver's default
 }
 
 type ReqAccountPassword struct {
@@ -133,6 +260,12 @@ type ReqAccountPassword struct {
 	Auth          interface{} `json:"auth"`
 }
 
+// ReqDeactivate is the JSON request for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-deactivate
+type ReqDeactivate struct {
+	Auth     interface{} `json:"auth,omitempty"`
+	IDServer string      `json:"id_server,omitempty"`
+}
+
 type ReqUserDirectorySearch struct {
 	Limit      int32  `json:"limit"`
 	SearchTerm string `json:"search_term"`
@@ -146,3 +279,15 @@ type ReqPutPushRule struct {
 	Conditions []PushCondition  `json:"conditions"`
 	Pattern    string           `json:"pattern"`
 }
+
+// ReqUploadKeys is the JSON request for https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3keysupload
+// The keys are passed through as they are, so they must be created and signed by an external crypto library.
+type ReqUploadKeys struct {
+	DeviceKeys   json.RawMessage `json:"device_keys,omitempty"`
+	OneTimeKeys  json.RawMessage `json:"one_time_keys,omitempty"`
+	FallbackKeys json.RawMessage `json:"fallback_keys,omitempty"` // Used once the one-time keys run out
+}
+
+// ReqUploadSignatures is the JSON request for https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3keyssignaturesupload
+// It maps user IDs to key IDs, such as a device ID or a base64 cross-signing public key, to the signed key object.
+type ReqUploadSignatures map[string]map[string]json.RawMessage
@@ -1,11 +1,18 @@
 package gomatrix
 
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
 // RespError is the standard JSON error response from Homeservers. It also implements the Golang "error" interface.
 // See http://matrix.org/docs/spec/client_server/r0.2.0.html#api-standards
 type RespError struct {
 	ErrCode      string `json:"errcode"`
 	Err          string `json:"error"`
-	RetryAfterMs int    `json:"retry_after_ms"`
+	RetryAfterMs int    `json:"retry_after_ms"` // Set on M_LIMIT_EXCEEDED, or from the Retry-After header
+	SoftLogout   bool   `json:"soft_logout"`    // Set on M_UNKNOWN_TOKEN if the device can be kept by refreshing or re-logging in
 }
 
 // Error returns the errcode and error message.
@@ -20,7 +27,24 @@ type RespCreateFilter struct {
 
 // RespVersions is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-versions
 type RespVersions struct {
-	Versions []string `json:"versions"`
+	Versions         []string        `json:"versions"`
+	UnstableFeatures map[string]bool `json:"unstable_features,omitempty"`
+}
+
+// Supports returns true if the homeserver advertises the given spec version, e.g. "v1.5" or "r0.6.1".
+func (r RespVersions) Supports(version string) bool {
+	for _, v := range r.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// HasUnstableFeature returns true if the homeserver advertises the given unstable feature flag as enabled, e.g.
+// "org.matrix.msc3440.stable".
+func (r RespVersions) HasUnstableFeature(flag string) bool {
+	return r.UnstableFeatures[flag]
 }
 
 // RespPublicRooms is the JSON response for http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#get-matrix-client-unstable-publicrooms
@@ -31,6 +55,24 @@ type RespPublicRooms struct {
 	Chunk                  []PublicRoom `json:"chunk"`
 }
 
+// RespRoomSummary is the JSON response for https://github.com/matrix-org/matrix-spec-proposals/pull/3266
+type RespRoomSummary struct {
+	RoomID           string   `json:"room_id"`
+	CanonicalAlias   string   `json:"canonical_alias,omitempty"`
+	Name             string   `json:"name,omitempty"`
+	Topic            string   `json:"topic,omitempty"`
+	AvatarURL        string   `json:"avatar_url,omitempty"`
+	NumJoinedMembers int      `json:"num_joined_members"`
+	JoinRule         string   `json:"join_rule,omitempty"`
+	RoomType         string   `json:"room_type,omitempty"`
+	RoomVersion      string   `json:"room_version,omitempty"`
+	Encryption       string   `json:"encryption,omitempty"`
+	WorldReadable    bool     `json:"world_readable"`
+	GuestCanJoin     bool     `json:"guest_can_join"`
+	Membership       string   `json:"membership,omitempty"`
+	AllowedRoomIDs   []string `json:"allowed_room_ids,omitempty"`
+}
+
 // RespJoinRoom is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-join
 type RespJoinRoom struct {
 	RoomID string `json:"room_id"`
@@ -70,6 +112,30 @@ type RespJoinedMembers struct {
 	} `json:"joined"`
 }
 
+// DisplayNames returns a map of the user IDs of the joined members which have a display name to their display name.
+func (r *RespJoinedMembers) DisplayNames() map[string]string {
+	names := make(map[string]string, len(r.Joined))
+	for userID, member := range r.Joined {
+		if member.DisplayName != nil && *member.DisplayName != "" {
+			names[userID] = *member.DisplayName
+		}
+	}
+	return names
+}
+
+// FindByDisplayName returns the sorted user IDs of the joined members whose display name is name, ignoring case, so
+// that a name typed by a human can be resolved. More than one user ID is returned if the name is ambiguous.
+func (r *RespJoinedMembers) FindByDisplayName(name string) []string {
+	var userIDs []string
+	for userID, displayName := range r.DisplayNames() {
+		if strings.EqualFold(displayName, name) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
 // RespMessages is the JSON response for https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-rooms-roomid-messages
 type RespMessages struct {
 	Start string  `json:"start"`
@@ -115,6 +181,7 @@ type RespUserDisplayName struct {
 }
 
 // RespUserStatus is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-presence-userid-status
+// It is also the content of m.presence events received in /sync.
 type RespUserStatus struct {
 	Presence        string `json:"presence"`
 	StatusMsg       string `json:"status_msg"`
@@ -133,12 +200,60 @@ type RespRegister struct {
 
 // RespLogin is the JSON response for http://matrix.org/docs/spec/client_server/r0.6.0.html#post-matrix-client-r0-login
 type RespLogin struct {
-	AccessToken string               `json:"access_token"`
-	DeviceID    string               `json:"device_id"`
-	HomeServer  string               `json:"home_server"`
-	UserID      string               `json:"user_id"`
-	WellKnown   DiscoveryInformation `json:"well_known"`
-	TotpSid     string               `json:"totp_sid"`
+	AccessToken  string               `json:"access_token"`
+	DeviceID     string               `json:"device_id"`
+	HomeServer   string               `json:"home_server"`
+	UserID       string               `json:"user_id"`
+	WellKnown    DiscoveryInformation `json:"well_known"`
+	TotpSid      string               `json:"totp_sid"`
+	RefreshToken string               `json:"refresh_token,omitempty"`
+	ExpiresInMs  int64                `json:"expires_in_ms,omitempty"`
+}
+
+// RespRefresh is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#post_matrixclientv3refresh
+type RespRefresh struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMs  int64  `json:"expires_in_ms,omitempty"`
+}
+
+// RespLoginFlows is the JSON response for https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv3login
+type RespLoginFlows struct {
+	Flows []LoginFlow `json:"flows"`
+}
+
+// LoginFlow is a login type supported by the homeserver. IdentityProviders is only set for m.login.sso.
+type LoginFlow struct {
+	Type              string             `json:"type"`
+	IdentityProviders []IdentityProvider `json:"identity_providers,omitempty"`
+}
+
+// IdentityProvider is an SSO identity provider - https://spec.matrix.org/v1.3/client-server-api/#definition-mloginsso-flow-schema
+type IdentityProvider struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Icon  string `json:"icon,omitempty"`
+	Brand string `json:"brand,omitempty"`
+}
+
+// HasFlow returns true if the homeserver supports the given login type, e.g. "m.login.sso".
+func (r RespLoginFlows) HasFlow(flowType string) bool {
+	for _, f := range r.Flows {
+		if f.Type == flowType {
+			return true
+		}
+	}
+	return false
+}
+
+// SSOIdentityProviders returns the identity providers advertised by the m.login.sso flow, if any.
+func (r RespLoginFlows) SSOIdentityProviders() []IdentityProvider {
+	for _, f := range r.Flows {
+		if f.Type == "m.login.sso" {
+			return f.IdentityProviders
+		}
+	}
+	return nil
 }
 
 // DiscoveryInformation is the JSON Response for https://matrix.org/docs/spec/client_server/r0.6.0#get-well-known-matrix-client and a part of the JSON Response for https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-login
@@ -160,6 +275,8 @@ type RespLogoutAll struct{}
 // RespCreateRoom is the JSON response for https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
 type RespCreateRoom struct {
 	RoomID string `json:"room_id"`
+	// The full alias of the room, if room_alias_name was set in the request.
+	RoomAlias string `json:"room_alias,omitempty"`
 }
 
 // RespSync is the JSON response for http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-sync
@@ -181,6 +298,9 @@ type RespSync struct {
 				Limited   bool    `json:"limited"`
 				PrevBatch string  `json:"prev_batch"`
 			} `json:"timeline"`
+			AccountData struct {
+				Events []Event `json:"events"`
+			} `json:"account_data"`
 		} `json:"leave"`
 		Join map[string]struct {
 			State struct {
@@ -194,6 +314,9 @@ type RespSync struct {
 			Ephemeral struct {
 				Events []Event `json:"events"`
 			} `json:"ephemeral"`
+			AccountData struct {
+				Events []Event `json:"events"`
+			} `json:"account_data"`
 		} `json:"join"`
 		Invite map[string]struct {
 			State struct {
@@ -207,6 +330,45 @@ type RespSync struct {
 	} `json:"multiroom"`
 }
 
+// JoinedRoomIDs returns the IDs of the joined rooms in the response, sorted.
+func (r *RespSync) JoinedRoomIDs() []string {
+	roomIDs := make([]string, 0, len(r.Rooms.Join))
+	for roomID := range r.Rooms.Join {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
+// TimelineEvents returns the timeline events of the given joined room, with RoomID set, or nil if the room isn't
+// in the response.
+func (r *RespSync) TimelineEvents(roomID string) []Event {
+	room, ok := r.Rooms.Join[roomID]
+	if !ok {
+		return nil
+	}
+	events := make([]Event, len(room.Timeline.Events))
+	for i, event := range room.Timeline.Events {
+		event.RoomID = roomID
+		events[i] = event
+	}
+	return events
+}
+
+// AllMessages returns the m.room.message events in the timelines of all joined rooms, with RoomID set. Events are
+// grouped by room in the order of JoinedRoomIDs, and are in timeline order within a room.
+func (r *RespSync) AllMessages() []Event {
+	var messages []Event
+	for _, roomID := range r.JoinedRoomIDs() {
+		for _, event := range r.TimelineEvents(roomID) {
+			if event.Type == "m.room.message" {
+				messages = append(messages, event)
+			}
+		}
+	}
+	return messages
+}
+
 // RespTurnServer is the JSON response from a Turn Server
 type RespTurnServer struct {
 	Username string   `json:"username"`
@@ -232,6 +394,19 @@ type RespGetDevices struct {
 	Devices []Device `json:"devices"`
 }
 
+// SortByLastSeen sorts the devices in place, most recently seen first. Devices which have never been seen come last.
+// Devices seen at the same time are sorted by device ID.
+func (r *RespGetDevices) SortByLastSeen() {
+	sort.SliceStable(r.Devices, func(i, j int) bool {
+		a, b := r.Devices[i], r.Devices[j]
+		if a.LastSeenTs != b.LastSeenTs {
+			return a.LastSeenTs > b.LastSeenTs
+		}
+		return a.DeviceId < b.DeviceId
+	})
+}
+
+// Device is a device of the current user, see https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-devices
 type Device struct {
 	DeviceId    string `json:"device_id" example:"l4kRnv3u"`
 	DisplayName string `json:"display_name" example:"web"`
@@ -251,6 +426,11 @@ type ThreePID struct {
 	ValidatedAt int    `json:"validated_at"`
 }
 
+// RespDeleteThreePID is JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-3pid-delete
+type RespDeleteThreePID struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"` // "success" or "no-support"
+}
+
 // RespAccountData is JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-user-userid-account-data-type
 type RespAccountData map[string]interface{}
 
@@ -264,6 +444,11 @@ type RespEmailRequestToken struct {
 	SumbitURL string `json:"submit_url"`
 }
 
+// RespSubmitToken is JSON response for https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-validate-msisdn-submittoken
+type RespSubmitToken struct {
+	Success bool `json:"success"`
+}
+
 // Order "a" for primary public room, "aaa" default.
 type Content struct {
 	Order string `json:"order"`
@@ -282,7 +467,13 @@ type HierarchyRoom struct {
 }
 
 type RespHierarchy struct {
-	Rooms []HierarchyRoom `json:"rooms"`
+	Rooms     []HierarchyRoom `json:"rooms"`
+	NextBatch string          `json:"next_batch,omitempty"` // Empty when there are no more pages
+}
+
+// RespDeactivate is the JSON response for https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-account-deactivate
+type RespDeactivate struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"` // "success" or "no-support"
 }
 
 type RespUserDirectorySearch struct {
@@ -296,3 +487,14 @@ type Result struct {
 	UserId      string `json:"user_id"`
 	Status      int32  `json:"status"`
 }
+
+// RespUploadKeys is the JSON response for https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3keysupload
+type RespUploadKeys struct {
+	OneTimeKeyCounts map[string]int `json:"one_time_key_counts"` // Number of unclaimed one-time keys per algorithm
+}
+
+// RespUploadSignatures is the JSON response for https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3keyssignaturesupload
+type RespUploadSignatures struct {
+	// The signatures which were rejected, by user ID and key ID, as a Matrix error object.
+	Failures map[string]map[string]json.RawMessage `json:"failures,omitempty"`
+}
@@ -2,8 +2,9 @@ package gomatrix
 
 // Room represents a single Matrix room.
 type Room struct {
-	ID    string
-	State map[string]map[string]*Event
+	ID          string
+	State       map[string]map[string]*Event
+	AccountData map[string]*Event // Per-room account data of the client's user, by event type, e.g. m.tag and m.fully_read
 }
 
 // PublicRoom represents the information about a public room obtainable from the room directory
@@ -19,6 +20,28 @@ type PublicRoom struct {
 	Aliases          []string `json:"aliases"`
 }
 
+// JoinedRoomSummary is the name and avatar of a joined room, as returned by Client.JoinedRoomsSummary.
+type JoinedRoomSummary struct {
+	RoomID    string
+	Name      string
+	AvatarURL string
+	// The error encountered while fetching the room's state, if any.
+	Err error
+}
+
+// matches returns true if roomIDorAlias is the room ID or one of the aliases of the room.
+func (room PublicRoom) matches(roomIDorAlias string) bool {
+	if room.RoomID == roomIDorAlias || room.CanonicalAlias == roomIDorAlias {
+		return true
+	}
+	for _, alias := range room.Aliases {
+		if alias == roomIDorAlias {
+			return true
+		}
+	}
+	return false
+}
+
 // UpdateState updates the room's current state with the given Event. This will clobber events based
 // on the type/state_key combination.
 func (room Room) UpdateState(event *Event) {
@@ -29,6 +52,30 @@ func (room Room) UpdateState(event *Event) {
 	room.State[event.Type][*event.StateKey] = event
 }
 
+// UpdateAccountData updates the room's account data with the given Event, replacing any previous
+// account data of the same type.
+func (room *Room) UpdateAccountData(event *Event) {
+	if room.AccountData == nil {
+		room.AccountData = make(map[string]*Event)
+	}
+	room.AccountData[event.Type] = event
+}
+
+// GetAccountData returns the room account data event of the given type, or nil.
+func (room Room) GetAccountData(eventType string) *Event {
+	return room.AccountData[eventType]
+}
+
+// FullyRead returns the event ID of the user's m.fully_read marker in this room, or "" if unknown.
+func (room Room) FullyRead() string {
+	event := room.GetAccountData("m.fully_read")
+	if event == nil {
+		return ""
+	}
+	eventID, _ := event.Content["event_id"].(string)
+	return eventID
+}
+
 // GetStateEvent returns the state event for the given type/state_key combo, or nil.
 func (room Room) GetStateEvent(eventType string, stateKey string) *Event {
 	stateEventMap := room.State[eventType]
@@ -37,7 +84,8 @@ func (room Room) GetStateEvent(eventType string, stateKey string) *Event {
 }
 
 // GetMembershipState returns the membership state of the given user ID in this room. If there is
-// no entry for this member, 'leave' is returned for consistency with left users.
+// no entry for this member, 'leave' is returned for consistency with left users. Note that when
+// members are lazy loaded, users who have not spoken yet have no entry either.
 func (room Room) GetMembershipState(userID string) string {
 	state := "leave"
 	event := room.GetStateEvent("m.room.member", userID)
@@ -57,7 +105,8 @@ func (room Room) GetMembershipState(userID string) string {
 func NewRoom(roomID string) *Room {
 	// Init the State map and return a pointer to the Room
 	return &Room{
-		ID:    roomID,
-		State: make(map[string]map[string]*Event),
+		ID:          roomID,
+		State:       make(map[string]map[string]*Event),
+		AccountData: make(map[string]*Event),
 	}
 }
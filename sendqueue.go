@@ -0,0 +1,108 @@
+package gomatrix
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RoomSendQueue sends message events one at a time per room, waiting at least Interval between sends to the same
+// room, so that bursts of messages don't hit the homeserver's rate limits. Events sent to the same room are sent in
+// the order Send was called, while different rooms are sent to concurrently.
+//
+// If a send is rate limited anyway, it is retried with the same transaction ID after the delay requested by the
+// homeserver, up to MaxRetries times.
+//
+// A RoomSendQueue created as a struct literal rather than with NewRoomSendQueue is ready to use, and doesn't retry.
+type RoomSendQueue struct {
+	Client *Client
+	// The minimum time between two sends to the same room.
+	Interval time.Duration
+	// The number of times a send is retried after an M_LIMIT_EXCEEDED error.
+	MaxRetries int
+
+	roomsMutex sync.Mutex                // protects rooms
+	rooms      map[string][]*queuedEvent // room ID to pending events, present while the room's worker is running
+}
+
+// SendResult is the outcome of an event sent with RoomSendQueue.Send.
+type SendResult struct {
+	Resp *RespSendEvent
+	Err  error
+}
+
+type queuedEvent struct {
+	ctx       context.Context
+	eventType string
+	txnID     string
+	content   interface{}
+	result    chan SendResult
+}
+
+// NewRoomSendQueue creates a RoomSendQueue which sends at most one event per interval to each room.
+func NewRoomSendQueue(cli *Client, interval time.Duration) *RoomSendQueue {
+	return &RoomSendQueue{
+		Client:     cli,
+		Interval:   interval,
+		MaxRetries: 3,
+	}
+}
+
+// Send queues a message event to be sent into a room. The returned channel receives exactly one SendResult once the
+// event has been sent or has failed. If ctx is done before the event is sent, it is dropped and the result is
+// ctx.Err().
+func (q *RoomSendQueue) Send(ctx context.Context, roomID, eventType string, content interface{}) <-chan SendResult {
+	ev := &queuedEvent{
+		ctx:       ctx,
+		eventType: eventType,
+		txnID:     txnID(),
+		content:   content,
+		result:    make(chan SendResult, 1),
+	}
+	q.roomsMutex.Lock()
+	if q.rooms == nil {
+		q.rooms = make(map[string][]*queuedEvent)
+	}
+	pending, running := q.rooms[roomID]
+	q.rooms[roomID] = append(pending, ev)
+	q.roomsMutex.Unlock()
+	if !running {
+		go q.run(roomID)
+	}
+	return ev.result
+}
+
+// run sends the pending events of a room until there are none left.
+func (q *RoomSendQueue) run(roomID string) {
+	var lastSend time.Time
+	for {
+		q.roomsMutex.Lock()
+		pending := q.rooms[roomID]
+		if len(pending) == 0 {
+			delete(q.rooms, roomID)
+			q.roomsMutex.Unlock()
+			return
+		}
+		ev := pending[0]
+		q.rooms[roomID] = pending[1:]
+		q.roomsMutex.Unlock()
+
+		if err := sleepContext(ev.ctx, time.Until(lastSend.Add(q.Interval))); err != nil {
+			ev.result <- SendResult{Err: err}
+			continue
+		}
+		resp, err := q.send(roomID, ev)
+		lastSend = time.Now()
+		ev.result <- SendResult{Resp: resp, Err: err}
+	}
+}
+
+func (q *RoomSendQueue) send(roomID string, ev *queuedEvent) (resp *RespSendEvent, err error) {
+	err = retryRateLimited(ev.ctx, q.MaxRetries, func() time.Duration {
+		return q.Interval
+	}, func() (err error) {
+		resp, err = q.Client.SendMessageEventWithTxn(ev.ctx, roomID, ev.eventType, ev.txnID, ev.content)
+		return
+	})
+	return
+}
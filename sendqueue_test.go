@@ -0,0 +1,91 @@
+package gomatrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoomSendQueue(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		sent      = make(map[string][]string)
+		sentAt    = make(map[string][]time.Time)
+		limitOnce = true
+	)
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		parts := strings.Split(req.URL.Path, "/")
+		if len(parts) < 8 || parts[6] != "send" {
+			return nil, fmt.Errorf("unhandled URL: %s", req.URL.Path)
+		}
+		roomID := parts[5]
+		var content map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&content); err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if content["body"] == "a2" && limitOnce {
+			limitOnce = false
+			return &http.Response{
+				StatusCode: 429,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":10}`)),
+			}, nil
+		}
+		sent[roomID] = append(sent[roomID], content["body"])
+		sentAt[roomID] = append(sentAt[roomID], time.Now())
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$` + content["body"] + `"}`)),
+		}, nil
+	})
+
+	interval := 20 * time.Millisecond
+	q := NewRoomSendQueue(cli, interval)
+	var results []<-chan SendResult
+	for i := 1; i <= 3; i++ {
+		results = append(results, q.Send(ctx, "!a:bar", "m.room.message", map[string]string{"body": fmt.Sprintf("a%d", i)}))
+		results = append(results, q.Send(ctx, "!b:bar", "m.room.message", map[string]string{"body": fmt.Sprintf("b%d", i)}))
+	}
+	for _, ch := range results {
+		if res := <-ch; res.Err != nil {
+			t.Fatalf("Send: error, got %s", res.Err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(sent["!a:bar"], ","); got != "a1,a2,a3" {
+		t.Fatalf("RoomSendQueue: sent %s to !a:bar, want a1,a2,a3 in order", got)
+	}
+	if got := strings.Join(sent["!b:bar"], ","); got != "b1,b2,b3" {
+		t.Fatalf("RoomSendQueue: sent %s to !b:bar, want b1,b2,b3 in order", got)
+	}
+	for roomID, times := range sentAt {
+		for i := 1; i < len(times); i++ {
+			if d := times[i].Sub(times[i-1]); d < interval {
+				t.Errorf("RoomSendQueue: sent to %s %s after the previous event, want at least %s", roomID, d, interval)
+			}
+		}
+	}
+}
+
+func TestRoomSendQueue_ZeroValue(t *testing.T) {
+	cli := mockClient(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`{"event_id":"$a1"}`)),
+		}, nil
+	})
+	q := &RoomSendQueue{Client: cli}
+	res := <-q.Send(ctx, "!a:bar", "m.room.message", map[string]string{"body": "a1"})
+	if res.Err != nil || res.Resp.EventID != "$a1" {
+		t.Fatalf("Send: got %+v, %v", res.Resp, res.Err)
+	}
+}
@@ -1,10 +1,24 @@
 package gomatrix
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
 // Storer is an interface which must be satisfied to store client data.
 //
 // You can either write a struct which persists this data to disk, or you can use the
 // provided "InMemoryStore" which just keeps data around in-memory which is lost on
 // restarts.
+//
+// DefaultSyncer saves every room touched by a /sync response, including membership changes
+// from the timeline, so LoadRoom(roomID).GetMembershipState(userID) can be used to check
+// membership without another request.
 type Storer interface {
 	SaveFilterID(userID, filterID string)
 	LoadFilterID(userID string) string
@@ -63,3 +77,124 @@ func NewInMemoryStore() *InMemoryStore {
 		Rooms:     make(map[string]*Room),
 	}
 }
+
+// FileStore implements the Storer interface.
+//
+// Filter IDs and next batch tokens are kept in memory and persisted as JSON to a single file, which is rewritten
+// atomically (by writing a temporary file and renaming it over the original) on every save, so a crash mid-write
+// never leaves a corrupt file behind. Rooms are kept in memory only and are lost on restarts.
+type FileStore struct {
+	Path string
+	// Called if persisting to Path fails. The in-memory state is still updated.
+	OnSaveError func(err error)
+
+	mutex sync.Mutex
+	data  fileStoreData
+	rooms map[string]*Room
+}
+
+type fileStoreData struct {
+	Filters   map[string]string `json:"filters"`
+	NextBatch map[string]string `json:"next_batch"`
+}
+
+// NewFileStore constructs a new FileStore which persists to the file at path. If the file does not exist or is
+// empty, the store starts out empty.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		Path:  path,
+		rooms: make(map[string]*Room),
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(contents)) > 0 {
+		if err := json.Unmarshal(contents, &s.data); err != nil {
+			return nil, fmt.Errorf("failed to load file store %s: %w", path, err)
+		}
+	}
+	if s.data.Filters == nil {
+		s.data.Filters = make(map[string]string)
+	}
+	if s.data.NextBatch == nil {
+		s.data.NextBatch = make(map[string]string)
+	}
+	return s, nil
+}
+
+// SaveFilterID to memory and to disk.
+func (s *FileStore) SaveFilterID(userID, filterID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.Filters[userID] = filterID
+	s.persist()
+}
+
+// LoadFilterID from memory.
+func (s *FileStore) LoadFilterID(userID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data.Filters[userID]
+}
+
+// SaveNextBatch to memory and to disk.
+func (s *FileStore) SaveNextBatch(userID, nextBatchToken string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data.NextBatch[userID] = nextBatchToken
+	s.persist()
+}
+
+// LoadNextBatch from memory.
+func (s *FileStore) LoadNextBatch(userID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data.NextBatch[userID]
+}
+
+// SaveRoom to memory.
+func (s *FileStore) SaveRoom(room *Room) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rooms[room.ID] = room
+}
+
+// LoadRoom from memory.
+func (s *FileStore) LoadRoom(roomID string) *Room {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rooms[roomID]
+}
+
+// persist must be called with the mutex held.
+func (s *FileStore) persist() {
+	if err := s.writeFile(); err != nil && s.OnSaveError != nil {
+		s.OnSaveError(err)
+	}
+}
+
+func (s *FileStore) writeFile() error {
+	contents, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// Clean up the temporary file if anything below fails. After a successful rename this is a no-op.
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
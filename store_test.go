@@ -0,0 +1,48 @@
+package gomatrix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomatrix")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore: error on missing file, got %s", err)
+	}
+	if got := s.LoadNextBatch("@alice:bar"); got != "" {
+		t.Fatalf("LoadNextBatch: got %s, want empty", got)
+	}
+	s.OnSaveError = func(err error) {
+		t.Fatalf("OnSaveError: %s", err)
+	}
+	s.SaveFilterID("@alice:bar", "7")
+	s.SaveNextBatch("@alice:bar", "s123")
+
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore: error on reload, got %s", err)
+	}
+	if got := s.LoadFilterID("@alice:bar"); got != "7" {
+		t.Fatalf("LoadFilterID: got %s, want %s", got, "7")
+	}
+	if got := s.LoadNextBatch("@alice:bar"); got != "s123" {
+		t.Fatalf("LoadNextBatch: got %s, want %s", got, "s123")
+	}
+
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if _, err := NewFileStore(path); err != nil {
+		t.Fatalf("NewFileStore: error on empty file, got %s", err)
+	}
+}
@@ -3,6 +3,7 @@ package gomatrix
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"runtime/debug"
 	"time"
 )
@@ -27,11 +28,54 @@ type DefaultSyncer struct {
 	Store             Storer
 	listeners         map[string][]OnEventListener // event type to listeners array
 	MultiRoomListener func(userId, mrType string, content interface{}, timestamp int64)
+
+	// OnFailedSync waits BackoffBase after the first failed /sync, doubling on every consecutive failure up to
+	// BackoffMax. Zero values use DefaultBackoffBase and DefaultBackoffMax.
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	failedSyncs int // consecutive failed /syncs, reset by ProcessResponse
+
+	// If true, GetFilterJSON asks the homeserver to lazy load room members: m.room.member events are only sent for
+	// the senders of timeline events, as they speak, rather than for every member of every room. The rooms saved to
+	// Store then only know about members which have been seen, so Room.GetMembershipState returns "leave" for members
+	// which haven't been loaded yet. Use Client.Members or Client.JoinedMembers for the full list.
+	LazyLoadMembers bool
+
+	// IsFatalError decides whether OnFailedSync should stop syncing for the given error rather than retrying it.
+	// If nil, IsFatalSyncError is used.
+	IsFatalError func(err error) bool
+
+	roomAccountDataListeners []OnRoomAccountDataListener
+	presenceListeners        []OnPresenceListener
+	ephemeralListeners       []OnEphemeralListener
+	tombstoneListeners       []OnTombstoneListener
 }
 
+// Default backoff used by DefaultSyncer.OnFailedSync.
+const (
+	DefaultBackoffBase = 1 * time.Second
+	DefaultBackoffMax  = 30 * time.Second
+)
+
 // OnEventListener can be used with DefaultSyncer.OnEventType to be informed of incoming events.
 type OnEventListener func(*Event)
 
+// OnEphemeralListener can be used with DefaultSyncer.OnEphemeral to be informed of ephemeral events in joined rooms,
+// such as m.typing and m.receipt.
+type OnEphemeralListener func(roomID string, event *Event)
+
+// OnPresenceListener can be used with DefaultSyncer.OnPresence to be informed of presence updates. The content of
+// the m.presence event is decoded into presence.
+type OnPresenceListener func(userID string, presence *RespUserStatus, event *Event)
+
+// OnRoomAccountDataListener can be used with DefaultSyncer.OnRoomAccountData to be informed of changes to per-room
+// account data such as m.tag.
+type OnRoomAccountDataListener func(roomID string, event *Event)
+
+// OnTombstoneListener can be used with DefaultSyncer.OnTombstone to be informed when a joined room is upgraded and
+// replaced by replacementRoomID.
+type OnTombstoneListener func(roomID, replacementRoomID string, event *Event)
+
 // NewDefaultSyncer returns an instantiated DefaultSyncer
 func NewDefaultSyncer(userID string, store Storer) *DefaultSyncer {
 	return &DefaultSyncer{
@@ -44,6 +88,7 @@ func NewDefaultSyncer(userID string, store Storer) *DefaultSyncer {
 // ProcessResponse processes the /sync response in a way suitable for bots. "Suitable for bots" means a stream of
 // unrepeating events. Returns a fatal error if a listener panics.
 func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error) {
+	s.failedSyncs = 0
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -53,40 +98,71 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 
 	for roomID, roomData := range res.Rooms.Join {
 		room := s.getOrCreateRoom(roomID)
-		for _, event := range roomData.State.Events {
+		// When lazy loading members, this includes the member events of new timeline senders, which are merged
+		// into the state already known about the room.
+		// Events are referenced by index rather than through the range variable, as the Storer may keep the
+		// pointers passed to UpdateState.
+		for i := range roomData.State.Events {
+			event := &roomData.State.Events[i]
+			event.RoomID = roomID
+			room.UpdateState(event)
+			s.notifyListeners(event)
+			s.notifyTombstoneListeners(roomID, event)
+		}
+		for i := range roomData.Timeline.Events {
+			event := &roomData.Timeline.Events[i]
 			event.RoomID = roomID
-			room.UpdateState(&event)
-			s.notifyListeners(&event)
+			// State changes such as membership updates arrive in the timeline too.
+			if event.StateKey != nil {
+				room.UpdateState(event)
+			}
+			s.notifyListeners(event)
+			s.notifyTombstoneListeners(roomID, event)
 		}
-		for _, event := range roomData.Timeline.Events {
+		for i := range roomData.Ephemeral.Events {
+			event := &roomData.Ephemeral.Events[i]
 			event.RoomID = roomID
-			s.notifyListeners(&event)
+			s.notifyListeners(event)
+			s.notifyEphemeralListeners(roomID, event)
 		}
-		for _, event := range roomData.Ephemeral.Events {
+		for i := range roomData.AccountData.Events {
+			event := &roomData.AccountData.Events[i]
 			event.RoomID = roomID
-			s.notifyListeners(&event)
+			room.UpdateAccountData(event)
+			s.notifyRoomAccountDataListeners(roomID, event)
 		}
+		s.Store.SaveRoom(room)
 	}
 	for roomID, roomData := range res.Rooms.Invite {
 		room := s.getOrCreateRoom(roomID)
-		for _, event := range roomData.State.Events {
+		for i := range roomData.State.Events {
+			event := &roomData.State.Events[i]
 			event.RoomID = roomID
-			room.UpdateState(&event)
-			s.notifyListeners(&event)
+			room.UpdateState(event)
+			s.notifyListeners(event)
 		}
+		s.Store.SaveRoom(room)
 	}
 	for roomID, roomData := range res.Rooms.Leave {
 		room := s.getOrCreateRoom(roomID)
-		for _, event := range roomData.Timeline.Events {
-			if event.StateKey != nil {
+		for i := range roomData.Timeline.Events {
+			if event := &roomData.Timeline.Events[i]; event.StateKey != nil {
 				event.RoomID = roomID
-				room.UpdateState(&event)
-				s.notifyListeners(&event)
+				room.UpdateState(event)
+				s.notifyListeners(event)
 			}
 		}
+		for i := range roomData.AccountData.Events {
+			event := &roomData.AccountData.Events[i]
+			event.RoomID = roomID
+			room.UpdateAccountData(event)
+			s.notifyRoomAccountDataListeners(roomID, event)
+		}
+		s.Store.SaveRoom(room)
 	}
 	for i := range res.Presence.Events {
 		s.notifyListeners(&res.Presence.Events[i])
+		s.notifyPresenceListeners(&res.Presence.Events[i])
 	}
 	if s.MultiRoomListener != nil {
 		for userId, userMr := range res.Multiroom {
@@ -108,6 +184,43 @@ func (s *DefaultSyncer) OnEventType(eventType string, callback OnEventListener)
 	s.listeners[eventType] = append(s.listeners[eventType], callback)
 }
 
+// OnRoomAccountData allows callers to be notified of per-room account data, such as m.tag events when the user
+// tags a room from another client. There are no duplicate checks. The latest account data of each type is also
+// kept on the rooms saved to Store, see Room.GetAccountData.
+func (s *DefaultSyncer) OnRoomAccountData(callback OnRoomAccountDataListener) {
+	s.roomAccountDataListeners = append(s.roomAccountDataListeners, callback)
+}
+
+// OnEphemeral allows callers to be notified of ephemeral events in joined rooms, such as typing notifications
+// and read receipts. There are no duplicate checks.
+func (s *DefaultSyncer) OnEphemeral(callback OnEphemeralListener) {
+	s.ephemeralListeners = append(s.ephemeralListeners, callback)
+}
+
+// OnPresence allows callers to be notified when users go online, offline or change their status message.
+// There are no duplicate checks.
+func (s *DefaultSyncer) OnPresence(callback OnPresenceListener) {
+	s.presenceListeners = append(s.presenceListeners, callback)
+}
+
+// OnTombstone allows callers to be notified when a joined room is upgraded, so that e.g. a bot can join the
+// replacement room. There are no duplicate checks.
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-tombstone
+func (s *DefaultSyncer) OnTombstone(callback OnTombstoneListener) {
+	s.tombstoneListeners = append(s.tombstoneListeners, callback)
+}
+
+// LastFullyRead returns the event ID of the user's m.fully_read marker in the given room, as last seen in /sync, or
+// "" if it is unknown. The marker is included in the first /sync, so this can be used to resume processing unread
+// events after a restart.
+func (s *DefaultSyncer) LastFullyRead(roomID string) string {
+	room := s.Store.LoadRoom(roomID)
+	if room == nil {
+		return ""
+	}
+	return room.FullyRead()
+}
+
 // shouldProcessResponse returns true if the response should be processed. May modify the response to remove
 // stuff that shouldn't be processed.
 func (s *DefaultSyncer) shouldProcessResponse(resp *RespSync, since string) bool {
@@ -165,12 +278,90 @@ func (s *DefaultSyncer) notifyListeners(event *Event) {
 	}
 }
 
-// OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
+func (s *DefaultSyncer) notifyRoomAccountDataListeners(roomID string, event *Event) {
+	for _, fn := range s.roomAccountDataListeners {
+		fn(roomID, event)
+	}
+}
+
+func (s *DefaultSyncer) notifyEphemeralListeners(roomID string, event *Event) {
+	for _, fn := range s.ephemeralListeners {
+		fn(roomID, event)
+	}
+}
+
+func (s *DefaultSyncer) notifyTombstoneListeners(roomID string, event *Event) {
+	if len(s.tombstoneListeners) == 0 || event.Type != "m.room.tombstone" || event.StateKey == nil || *event.StateKey != "" {
+		return
+	}
+	var tombstone TombstoneEventContent
+	if err := event.UnmarshalContent(&tombstone); err != nil || tombstone.ReplacementRoom == "" {
+		return
+	}
+	for _, fn := range s.tombstoneListeners {
+		fn(roomID, tombstone.ReplacementRoom, event)
+	}
+}
+
+func (s *DefaultSyncer) notifyPresenceListeners(event *Event) {
+	if len(s.presenceListeners) == 0 || event.Type != "m.presence" {
+		return
+	}
+	var presence RespUserStatus
+	if err := event.UnmarshalContent(&presence); err != nil {
+		return
+	}
+	for _, fn := range s.presenceListeners {
+		fn(event.Sender, &presence, event)
+	}
+}
+
+// IsFatalSyncError returns true for errors which retrying /sync cannot fix: the access token being unknown (including
+// soft logouts, which require a token refresh or a new login), missing, or belonging to a deactivated user.
+func IsFatalSyncError(err error) bool {
+	return IsMatrixError(err, ErrCodeUnknownToken) ||
+		IsMatrixError(err, ErrCodeMissingToken) ||
+		IsMatrixError(err, ErrCodeUserDeactivated)
+}
+
+// OnFailedSync returns an error, stopping Sync, if IsFatalError reports the error as fatal. Otherwise it returns an
+// exponentially increasing wait period between failed /syncs. The wait starts at BackoffBase and doubles on every
+// consecutive failure, capped at BackoffMax. Half of each wait is random jitter so that many clients don't reconnect
+// at the same moment after a homeserver restart. The backoff is reset by the next successful /sync.
 func (s *DefaultSyncer) OnFailedSync(res *RespSync, err error) (time.Duration, error) {
-	return 10 * time.Second, nil
+	isFatal := s.IsFatalError
+	if isFatal == nil {
+		isFatal = IsFatalSyncError
+	}
+	if isFatal(err) {
+		return 0, err
+	}
+	base, max := s.BackoffBase, s.BackoffMax
+	if base <= 0 {
+		base = DefaultBackoffBase
+	}
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+	wait := base
+	for i := 0; i < s.failedSyncs && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	s.failedSyncs++
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1)), nil
 }
 
-// GetFilterJSON returns a filter with a timeline limit of 50.
+// GetFilterJSON returns a filter with a timeline limit of 50, which lazy loads members if LazyLoadMembers is set.
 func (s *DefaultSyncer) GetFilterJSON(userID string) json.RawMessage {
-	return json.RawMessage(`{"room":{"timeline":{"limit":50}}}`)
+	filter := Filter{
+		Room: RoomFilter{
+			State:    FilterPart{LazyLoadMembers: s.LazyLoadMembers},
+			Timeline: FilterPart{Limit: 50, LazyLoadMembers: s.LazyLoadMembers},
+		},
+	}
+	filterJSON, _ := json.Marshal(filter) // a Filter always marshals
+	return filterJSON
 }
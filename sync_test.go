@@ -0,0 +1,378 @@
+package gomatrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultSyncer_TimelineMembership(t *testing.T) {
+	store := NewInMemoryStore()
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", store)
+
+	var res RespSync
+	err := json.Unmarshal([]byte(`{
+  "next_batch": "s2",
+  "rooms": {
+    "join": {
+      "!foo:bar": {
+        "state": {
+          "events": [
+            {"type": "m.room.member", "sender": "@carol:bar", "state_key": "@carol:bar", "event_id": "$0", "content": {"membership": "join"}},
+            {"type": "m.room.member", "sender": "@dave:bar", "state_key": "@dave:bar", "event_id": "$00", "content": {"membership": "invite"}}
+          ]
+        },
+        "timeline": {
+          "events": [
+            {
+              "type": "m.room.member",
+              "sender": "@alice:bar",
+              "state_key": "@alice:bar",
+              "event_id": "$1",
+              "content": {"membership": "join"}
+            },
+            {
+              "type": "m.room.member",
+              "sender": "@bob:bar",
+              "state_key": "@bob:bar",
+              "event_id": "$2",
+              "content": {"membership": "leave"}
+            }
+          ]
+        }
+      }
+    }
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+	if err := syncer.ProcessResponse(&res, "s1"); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+
+	room := store.LoadRoom("!foo:bar")
+	if room == nil {
+		t.Fatal("LoadRoom: got nil, want room")
+	}
+	for userID, want := range map[string]string{
+		"@alice:bar": "join",
+		"@bob:bar":   "leave",
+		"@carol:bar": "join",
+		"@dave:bar":  "invite",
+	} {
+		if got := room.GetMembershipState(userID); got != want {
+			t.Fatalf("GetMembershipState(%s): got %s, want %s", userID, got, want)
+		}
+	}
+}
+
+func TestDefaultSyncer_OnRoomAccountData(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+
+	var res RespSync
+	err := json.Unmarshal([]byte(`{
+  "next_batch": "s2",
+  "rooms": {
+    "join": {
+      "!foo:bar": {
+        "account_data": {
+          "events": [
+            {
+              "type": "m.tag",
+              "content": {"tags": {"m.favourite": {"order": 0.5}}}
+            }
+          ]
+        }
+      }
+    }
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+
+	var gotRoomID string
+	var tags TagContent
+	syncer.OnRoomAccountData(func(roomID string, ev *Event) {
+		if ev.Type != "m.tag" {
+			return
+		}
+		gotRoomID = roomID
+		if err := ev.UnmarshalContent(&tags); err != nil {
+			t.Fatalf("UnmarshalContent: %s", err)
+		}
+	})
+	if err := syncer.ProcessResponse(&res, "s1"); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+
+	if gotRoomID != "!foo:bar" {
+		t.Fatalf("OnRoomAccountData: got room %q, want !foo:bar", gotRoomID)
+	}
+	if tag, ok := tags.Tags["m.favourite"]; !ok || tag.Order != 0.5 {
+		t.Fatalf("OnRoomAccountData: got tags %+v, want m.favourite with order 0.5", tags.Tags)
+	}
+}
+
+func TestDefaultSyncer_OnEphemeral(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+
+	var res RespSync
+	err := json.Unmarshal([]byte(`{
+  "next_batch": "s2",
+  "rooms": {
+    "join": {
+      "!foo:bar": {
+        "ephemeral": {
+          "events": [
+            {"type": "m.typing", "content": {"user_ids": ["@alice:bar"]}},
+            {"type": "m.receipt", "content": {"$1": {"m.read": {"@bob:bar": {"ts": 1000}}}}}
+          ]
+        }
+      }
+    }
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+
+	var got []string
+	syncer.OnEphemeral(func(roomID string, ev *Event) {
+		got = append(got, roomID+" "+ev.Type+" "+ev.RoomID)
+	})
+	if err := syncer.ProcessResponse(&res, "s1"); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	want := "!foo:bar m.typing !foo:bar,!foo:bar m.receipt !foo:bar"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("OnEphemeral: got %v, want %s", got, want)
+	}
+}
+
+func TestDefaultSyncer_OnPresence(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+
+	var res RespSync
+	err := json.Unmarshal([]byte(`{
+  "next_batch": "s2",
+  "presence": {
+    "events": [
+      {
+        "type": "m.presence",
+        "sender": "@alice:bar",
+        "content": {"presence": "online", "status_msg": "Busy", "currently_active": true}
+      }
+    ]
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+
+	var gotUserID string
+	var got *RespUserStatus
+	syncer.OnPresence(func(userID string, presence *RespUserStatus, ev *Event) {
+		gotUserID = userID
+		got = presence
+	})
+	if err := syncer.ProcessResponse(&res, "s1"); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+
+	if gotUserID != "@alice:bar" || got == nil {
+		t.Fatalf("OnPresence: got user %q, presence %v", gotUserID, got)
+	}
+	if got.Presence != "online" || got.StatusMsg != "Busy" || !got.CurrentlyActive {
+		t.Fatalf("OnPresence: got %+v", got)
+	}
+}
+
+func TestDefaultSyncer_OnFailedSyncBackoff(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+	syncer.BackoffBase = 100 * time.Millisecond
+	syncer.BackoffMax = time.Second
+
+	// Each wait is between half and all of base*2^n, capped at max.
+	wantMax := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, max := range wantMax {
+		wait, err := syncer.OnFailedSync(nil, fmt.Errorf("network error"))
+		if err != nil {
+			t.Fatalf("OnFailedSync: error, got %s", err)
+		}
+		if wait < max/2 || wait > max {
+			t.Fatalf("OnFailedSync: attempt %d got %s, want between %s and %s", i, wait, max/2, max)
+		}
+	}
+
+	if err := syncer.ProcessResponse(&RespSync{}, "s1"); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+	wait, _ := syncer.OnFailedSync(nil, fmt.Errorf("network error"))
+	if wait > 100*time.Millisecond {
+		t.Fatalf("OnFailedSync: got %s after a successful sync, want backoff to reset", wait)
+	}
+}
+
+func TestDefaultSyncer_OnFailedSyncFatal(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+
+	tokenErr := &HTTPError{Code: 401, MatrixError: RespError{ErrCode: ErrCodeUnknownToken, SoftLogout: true}}
+	if _, err := syncer.OnFailedSync(nil, tokenErr); err == nil {
+		t.Fatal("OnFailedSync: got nil error for M_UNKNOWN_TOKEN, want fatal error")
+	}
+	if _, err := syncer.OnFailedSync(nil, fmt.Errorf("connection refused")); err != nil {
+		t.Fatalf("OnFailedSync: got %s for a network error, want nil", err)
+	}
+
+	syncer.IsFatalError = func(err error) bool { return false }
+	if _, err := syncer.OnFailedSync(nil, tokenErr); err != nil {
+		t.Fatalf("OnFailedSync: got %s with overridden IsFatalError, want nil", err)
+	}
+}
+
+func TestDefaultSyncer_LazyLoadMembersFilter(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+	syncer.LazyLoadMembers = true
+
+	var filter Filter
+	if err := json.Unmarshal(syncer.GetFilterJSON("@user:test.gomatrix.org"), &filter); err != nil {
+		t.Fatalf("GetFilterJSON: invalid JSON: %s", err)
+	}
+	if !filter.Room.State.LazyLoadMembers || !filter.Room.Timeline.LazyLoadMembers {
+		t.Fatalf("GetFilterJSON: lazy_load_members not set: %+v", filter.Room)
+	}
+	if filter.Room.Timeline.Limit != 50 {
+		t.Fatalf("GetFilterJSON: got timeline limit %d, want 50", filter.Room.Timeline.Limit)
+	}
+}
+
+func TestDefaultSyncer_LastFullyRead(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+
+	var res RespSync
+	err := json.Unmarshal([]byte(`{
+  "next_batch": "s1",
+  "rooms": {
+    "join": {
+      "!foo:bar": {
+        "account_data": {
+          "events": [
+            {"type": "m.fully_read", "content": {"event_id": "$read"}},
+            {"type": "m.tag", "content": {"tags": {"u.work": {"order": 0.5}}}}
+          ]
+        }
+      }
+    }
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+	if err := syncer.ProcessResponse(&res, ""); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+
+	if got := syncer.LastFullyRead("!foo:bar"); got != "$read" {
+		t.Fatalf("LastFullyRead: got %q, want $read", got)
+	}
+	if got := syncer.LastFullyRead("!unknown:bar"); got != "" {
+		t.Fatalf("LastFullyRead: got %q for an unknown room, want empty", got)
+	}
+}
+
+func TestDefaultSyncer_OnTombstone(t *testing.T) {
+	syncer := NewDefaultSyncer("@user:test.gomatrix.org", NewInMemoryStore())
+
+	var res RespSync
+	err := json.Unmarshal([]byte(`{
+  "next_batch": "s2",
+  "rooms": {
+    "join": {
+      "!old:bar": {
+        "timeline": {
+          "events": [
+            {
+              "type": "m.room.tombstone",
+              "sender": "@admin:bar",
+              "state_key": "",
+              "event_id": "$tomb",
+              "content": {"body": "This room has been replaced", "replacement_room": "!new:bar"}
+            }
+          ]
+        }
+      }
+    }
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+
+	var gotRoomID, gotReplacement string
+	syncer.OnTombstone(func(roomID, replacementRoomID string, ev *Event) {
+		gotRoomID = roomID
+		gotReplacement = replacementRoomID
+	})
+	if err := syncer.ProcessResponse(&res, "s1"); err != nil {
+		t.Fatalf("ProcessResponse: error, got %s", err)
+	}
+
+	if gotRoomID != "!old:bar" || gotReplacement != "!new:bar" {
+		t.Fatalf("OnTombstone: got room %q replaced by %q", gotRoomID, gotReplacement)
+	}
+}
+
+func TestRespSync_Accessors(t *testing.T) {
+	var res RespSync
+	err := json.Unmarshal([]byte(`{
+  "next_batch": "s2",
+  "rooms": {
+    "join": {
+      "!b:bar": {
+        "timeline": {
+          "events": [
+            {"type": "m.room.message", "sender": "@alice:bar", "event_id": "$3", "content": {"msgtype": "m.text", "body": "hi"}}
+          ]
+        }
+      },
+      "!a:bar": {
+        "timeline": {
+          "events": [
+            {"type": "m.room.message", "sender": "@alice:bar", "event_id": "$1", "content": {"msgtype": "m.text", "body": "one"}},
+            {"type": "m.room.topic", "sender": "@alice:bar", "state_key": "", "event_id": "$2", "content": {"topic": "t"}}
+          ]
+        }
+      }
+    }
+  }
+}`), &res)
+	if err != nil {
+		t.Fatalf("failed to unmarshal sync response: %s", err)
+	}
+
+	if got := fmt.Sprint(res.JoinedRoomIDs()); got != "[!a:bar !b:bar]" {
+		t.Fatalf("JoinedRoomIDs: got %s", got)
+	}
+	events := res.TimelineEvents("!a:bar")
+	if len(events) != 2 || events[0].ID != "$1" || events[0].RoomID != "!a:bar" {
+		t.Fatalf("TimelineEvents: got %+v", events)
+	}
+	if events := res.TimelineEvents("!c:bar"); events != nil {
+		t.Fatalf("TimelineEvents: got %+v for unknown room, want nil", events)
+	}
+	messages := res.AllMessages()
+	if len(messages) != 2 || messages[0].ID != "$1" || messages[1].ID != "$3" || messages[1].RoomID != "!b:bar" {
+		t.Fatalf("AllMessages: got %+v", messages)
+	}
+}
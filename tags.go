@@ -14,6 +14,8 @@
 
 package gomatrix
 
+import "sort"
+
 // TagContent contains the data for an m.tag message type
 // https://matrix.org/docs/spec/client_server/r0.4.0.html#m-tag
 type TagContent struct {
@@ -24,3 +26,54 @@ type TagContent struct {
 type TagProperties struct {
 	Order float32 `json:"order,omitempty"` // Empty values must be neglected
 }
+
+// TaggedRoom is a room with the order it has within a tag.
+type TaggedRoom struct {
+	RoomID string
+	Order  float32
+}
+
+// SortTaggedRooms returns the rooms which have the given tag, from a map of room IDs to the content of their m.tag
+// account data, sorted by order. Rooms with the same order, including rooms without one, are sorted by room ID so
+// that the result is stable.
+func SortTaggedRooms(roomTags map[string]TagContent, tag string) []TaggedRoom {
+	var rooms []TaggedRoom
+	for roomID, content := range roomTags {
+		if props, ok := content.Tags[tag]; ok {
+			rooms = append(rooms, TaggedRoom{RoomID: roomID, Order: props.Order})
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].Order != rooms[j].Order {
+			return rooms[i].Order < rooms[j].Order
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms
+}
+
+// InsertTagOrder returns the order to give a room so that it is placed at position in existing, the sorted orders
+// of the other rooms with the tag, e.g. after dragging it there. The order is the midpoint between its new
+// neighbours, using 0 and 1 as the bounds of the list. position is clamped to [0, len(existing)].
+//
+// Rooms with equal orders are sorted by room ID, so a room can't be placed between them: if the neighbours are
+// equal, the room is placed after all the rooms with that order instead.
+func InsertTagOrder(existing []float32, position int) float32 {
+	if position < 0 {
+		position = 0
+	}
+	if position > len(existing) {
+		position = len(existing)
+	}
+	lower, upper := float32(0), float32(1)
+	if position > 0 {
+		lower = existing[position-1]
+	}
+	for _, order := range existing[position:] {
+		if order > lower {
+			upper = order
+			break
+		}
+	}
+	return lower + (upper-lower)/2
+}
@@ -0,0 +1,46 @@
+package gomatrix
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSortTaggedRooms(t *testing.T) {
+	roomTags := map[string]TagContent{
+		"!c:bar": {Tags: map[string]TagProperties{"m.favourite": {Order: 0.5}}},
+		"!b:bar": {Tags: map[string]TagProperties{"m.favourite": {Order: 0.25}}},
+		"!a:bar": {Tags: map[string]TagProperties{"m.favourite": {Order: 0.5}, "m.lowpriority": {}}},
+		"!d:bar": {Tags: map[string]TagProperties{"m.lowpriority": {}}},
+	}
+	if got := fmt.Sprint(SortTaggedRooms(roomTags, "m.favourite")); got != "[{!b:bar 0.25} {!a:bar 0.5} {!c:bar 0.5}]" {
+		t.Fatalf("SortTaggedRooms: got %s", got)
+	}
+	if got := fmt.Sprint(SortTaggedRooms(roomTags, "u.work")); got != "[]" {
+		t.Fatalf("SortTaggedRooms: got %s for an unused tag", got)
+	}
+}
+
+func TestInsertTagOrder(t *testing.T) {
+	tests := []struct {
+		existing []float32
+		position int
+		want     float32
+	}{
+		{[]float32{0.2, 0.4, 0.8}, 0, 0.1},
+		{[]float32{0.2, 0.4, 0.8}, 1, 0.3},
+		{[]float32{0.2, 0.4, 0.8}, 2, 0.6},
+		{[]float32{0.2, 0.4, 0.8}, 3, 0.9},
+		{[]float32{0.2, 0.4, 0.8}, -1, 0.1},
+		{[]float32{0.2, 0.4, 0.8}, 10, 0.9},
+		{nil, 0, 0.5},
+		// Between equal neighbours, the room goes after all of them.
+		{[]float32{0.2, 0.4, 0.4, 0.4, 0.8}, 2, 0.6},
+		{[]float32{0.2, 0.4, 0.4, 0.4, 0.8}, 1, 0.3},
+		{[]float32{0.5, 0.5}, 1, 0.75},
+	}
+	for _, tt := range tests {
+		if got := InsertTagOrder(tt.existing, tt.position); fmt.Sprintf("%.4f", got) != fmt.Sprintf("%.4f", tt.want) {
+			t.Errorf("InsertTagOrder(%v, %d): got %v, want %v", tt.existing, tt.position, got, tt.want)
+		}
+	}
+}